@@ -12,5 +12,43 @@ func CheckEnvVariable() {
 		logger.FatalLog("环境变量 QD_COOKIE 未设置")
 	}
 
+	if config.ApiKeyPoliciesErr != nil {
+		logger.FatalLog(config.ApiKeyPoliciesErr.Error())
+	}
+
+	if config.AuditRedactPatternsErr != nil {
+		logger.FatalLog(config.AuditRedactPatternsErr.Error())
+	}
+
+	if config.ProxyUrlsErr != nil {
+		logger.FatalLog(config.ProxyUrlsErr.Error())
+	}
+
+	if config.ProxyBindingsErr != nil {
+		logger.FatalLog(config.ProxyBindingsErr.Error())
+	}
+
+	if config.TLSProfilesErr != nil {
+		logger.FatalLog(config.TLSProfilesErr.Error())
+	}
+
+	switch config.TLSProfileStrategy {
+	case config.TLSProfileStrategyAccount, config.TLSProfileStrategyRandom, config.TLSProfileStrategyRoundRobin:
+	default:
+		logger.FatalLog("环境变量 TLS_PROFILE_STRATEGY 无效: " + config.TLSProfileStrategy)
+	}
+
+	if config.GlobalTransformPipelineErr != nil {
+		logger.FatalLog(config.GlobalTransformPipelineErr.Error())
+	}
+
+	if config.TransformPipelinesErr != nil {
+		logger.FatalLog(config.TransformPipelinesErr.Error())
+	}
+
+	if config.UpstreamErrorRulesErr != nil {
+		logger.FatalLog(config.UpstreamErrorRulesErr.Error())
+	}
+
 	logger.SysLog("environment variable check passed.")
 }
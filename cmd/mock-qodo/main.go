@@ -0,0 +1,35 @@
+package main
+
+import (
+	"flag"
+	"log"
+	"net/http"
+	"os"
+	mock_server "qodo2api/mock-server"
+)
+
+// mock-qodo 模拟Qodo聊天接口及Firebase token刷新接口,用于离线端到端测试
+//
+//	go run ./cmd/mock-qodo -addr :10080 -scenario scenario.json
+//	QODO_BASE_URL=http://127.0.0.1:10080 FIREBASE_TOKEN_URL=http://127.0.0.1:10080/v1/token ./qodo2api
+func main() {
+	addr := flag.String("addr", ":10080", "listen address")
+	scenarioFile := flag.String("scenario", "", "scenario JSON file, defaults to MOCK_SCENARIO_JSON")
+	flag.Parse()
+
+	data := os.Getenv("MOCK_SCENARIO_JSON")
+	if *scenarioFile != "" {
+		content, err := os.ReadFile(*scenarioFile)
+		if err != nil {
+			log.Fatal(err)
+		}
+		data = string(content)
+	}
+	scenario, err := mock_server.ParseScenario(data)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	log.Printf("mock qodo server listening on %s", *addr)
+	log.Fatal(http.ListenAndServe(*addr, mock_server.NewServer(scenario).Handler()))
+}
@@ -0,0 +1,109 @@
+package apierror
+
+import (
+	"encoding/json"
+	"net/http"
+	"qodo2api/model"
+
+	"github.com/gin-gonic/gin"
+)
+
+// OpenAI error.type
+const (
+	TypeInvalidRequest = "invalid_request_error"
+	TypePermission     = "permission_error"
+	TypeRequests       = "requests" // 请求数限流
+	TypeTokens         = "tokens"   // token限流
+	TypeQuota          = "insufficient_quota"
+	TypeServer         = "server_error"
+)
+
+// Error 返回给客户端的错误,按 OpenAI error 对象格式输出
+type Error struct {
+	Status  int
+	Type    string
+	Code    string
+	Message string
+}
+
+func (e *Error) Error() string {
+	return e.Message
+}
+
+func New(status int, errType, code, message string) *Error {
+	return &Error{Status: status, Type: errType, Code: code, Message: message}
+}
+
+type kind struct {
+	status  int
+	errType string
+}
+
+// classes 错误分类(即审计日志及追踪中的 error_class)对应的状态码及类型
+var classes = map[string]kind{
+	// 请求本身有误
+	"invalid_request":       {http.StatusBadRequest, TypeInvalidRequest},
+	"invalid_model":         {http.StatusBadRequest, TypeInvalidRequest},
+	"invalid_max_tokens":    {http.StatusBadRequest, TypeInvalidRequest},
+	"token_limit_exceeded":  {http.StatusBadRequest, TypeInvalidRequest},
+	"request_too_large":     {http.StatusRequestEntityTooLarge, TypeInvalidRequest},
+	"language_blocked":      {http.StatusBadRequest, TypeInvalidRequest},
+	"invalid_authorization": {http.StatusUnauthorized, TypeInvalidRequest},
+	"api_key_expired":       {http.StatusForbidden, TypeInvalidRequest},
+	"model_not_allowed":     {http.StatusForbidden, TypePermission},
+	"ip_blocked":            {http.StatusForbidden, TypePermission},
+	// 限流及额度
+	"rate_limit_exceeded":       {http.StatusTooManyRequests, TypeRequests},
+	"concurrent_limit_exceeded": {http.StatusTooManyRequests, TypeRequests},
+	"insufficient_quota":        {http.StatusTooManyRequests, TypeQuota},
+	// 上游失败
+	"upstream_request_failed":   {http.StatusBadGateway, TypeServer},
+	"upstream_network_error":    {http.StatusBadGateway, TypeServer},
+	"upstream_server_error":     {http.StatusBadGateway, TypeServer},
+	"upstream_empty_response":   {http.StatusBadGateway, TypeServer},
+	"upstream_invalid_response": {http.StatusBadGateway, TypeServer},
+	"upstream_forbidden":        {http.StatusBadGateway, TypeServer},
+	"upstream_error":            {http.StatusBadGateway, TypeServer},
+	"upstream_timeout":          {http.StatusGatewayTimeout, TypeServer},
+	// 暂不可用
+	"circuit_open":         {http.StatusServiceUnavailable, TypeServer},
+	"no_available_account": {http.StatusServiceUnavailable, TypeServer},
+	"accounts_exhausted":   {http.StatusServiceUnavailable, TypeServer},
+}
+
+// FromClass 按错误分类确定状态码及类型,未登记的分类按 500 server_error 处理
+func FromClass(class, message string) *Error {
+	k, ok := classes[class]
+	if !ok {
+		k = kind{http.StatusInternalServerError, TypeServer}
+	}
+	return New(k.status, k.errType, class, message)
+}
+
+// Write 输出错误: 尚未写出响应时按状态码返回JSON;流式响应已开始时以SSE事件发送错误,并以 [DONE] 结束流
+func Write(c *gin.Context, err *Error) {
+	body := model.OpenAIErrorResponse{
+		OpenAIError: model.OpenAIError{
+			Message: err.Message,
+			Type:    err.Type,
+			Code:    err.Code,
+		},
+	}
+	if c.Writer.Written() {
+		data, _ := json.Marshal(body)
+		c.SSEvent("", " "+string(data))
+		c.SSEvent("", " [DONE]")
+		c.Writer.Flush()
+		return
+	}
+	// 流式请求可能已设置 text/event-stream,尚未写出时改为JSON
+	c.Header("Content-Type", "application/json; charset=utf-8")
+	c.Header("Cache-Control", "")
+	c.JSON(err.Status, body)
+}
+
+// Abort 输出错误并中止后续处理
+func Abort(c *gin.Context, err *Error) {
+	Write(c, err)
+	c.Abort()
+}
@@ -0,0 +1,169 @@
+package audit
+
+import (
+	"encoding/json"
+	"fmt"
+	"qodo2api/common/rotatefile"
+	"qodo2api/common/secret"
+	"regexp"
+	"sync"
+	"time"
+)
+
+// Record 单次请求的审计记录,每条记录写为JSONL中的一行
+type Record struct {
+	Time             time.Time   `json:"time"`
+	RequestID        string      `json:"request_id"`
+	ApiKeyHash       string      `json:"api_key_hash,omitempty"`
+	Model            string      `json:"model"`
+	ActualModel      string      `json:"actual_model,omitempty"`
+	Account          string      `json:"account,omitempty"`
+	Stream           bool        `json:"stream"`
+	MessageCount     int         `json:"message_count"`
+	PromptTokens     int         `json:"prompt_tokens"`
+	CompletionTokens int         `json:"completion_tokens"`
+	LatencyMs        int64       `json:"latency_ms"`
+	StatusCode       int         `json:"status_code"`
+	FinishReason     string      `json:"finish_reason,omitempty"`
+	ErrorClass       string      `json:"error_class,omitempty"`
+	Prompt           interface{} `json:"prompt,omitempty"`
+	Response         string      `json:"response,omitempty"`
+}
+
+// Config 审计日志配置
+type Config struct {
+	Path           string        // 审计日志文件路径,为空时不记录
+	IncludeBodies  bool          // 是否记录完整的提示词及回复
+	RedactPatterns []string      // 记录提示词及回复前替换为 [REDACTED] 的正则
+	MaxSize        int64         // 单个文件的最大字节数
+	MaxBackups     int           // 保留的历史文件数
+	MaxAge         time.Duration // 历史文件保留时长
+}
+
+const redactedText = "[REDACTED]"
+
+var (
+	writer         *rotatefile.Writer
+	includeBodies  bool
+	redactPatterns []*regexp.Regexp
+	// Write 持读锁直至写入完成,Init 及 Close 持写锁,避免关闭后仍写入
+	mutex sync.RWMutex
+)
+
+// Init 按配置打开审计日志,Path为空时审计关闭
+func Init(config Config) error {
+	if config.Path == "" {
+		return nil
+	}
+	patterns := make([]*regexp.Regexp, 0, len(config.RedactPatterns))
+	for _, pattern := range config.RedactPatterns {
+		re, err := regexp.Compile(pattern)
+		if err != nil {
+			return fmt.Errorf("invalid audit redact pattern %q: %v", pattern, err)
+		}
+		patterns = append(patterns, re)
+	}
+	w, err := rotatefile.New(config.Path, rotatefile.Options{
+		MaxSize:    config.MaxSize,
+		MaxBackups: config.MaxBackups,
+		MaxAge:     config.MaxAge,
+	})
+	if err != nil {
+		return err
+	}
+
+	mutex.Lock()
+	defer mutex.Unlock()
+	writer = w
+	includeBodies = config.IncludeBodies
+	redactPatterns = patterns
+	return nil
+}
+
+// Enabled 审计日志是否开启
+func Enabled() bool {
+	mutex.RLock()
+	defer mutex.RUnlock()
+	return writer != nil
+}
+
+// Write 写入一条审计记录,未开启审计时忽略
+func Write(record *Record) error {
+	mutex.RLock()
+	defer mutex.RUnlock()
+	if writer == nil {
+		return nil
+	}
+
+	if includeBodies {
+		record.Prompt = redactValue(record.Prompt, redactPatterns)
+		record.Response = redact(record.Response, redactPatterns)
+	} else {
+		record.Prompt = nil
+		record.Response = ""
+	}
+
+	data, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+	_, err = writer.Write(append(data, '\n'))
+	return err
+}
+
+// Close 刷新并关闭审计日志
+func Close() error {
+	mutex.Lock()
+	defer mutex.Unlock()
+	if writer == nil {
+		return nil
+	}
+	_ = writer.Sync()
+	err := writer.Close()
+	writer = nil
+	return err
+}
+
+// redact 隐藏已登记的密钥及可识别格式的密钥,再按配置的正则脱敏
+func redact(text string, patterns []*regexp.Regexp) string {
+	text = secret.Redact(text)
+	for _, re := range patterns {
+		text = re.ReplaceAllString(text, redactedText)
+	}
+	return text
+}
+
+// redactValue 对任意可JSON序列化的值中的字符串逐一脱敏
+func redactValue(value interface{}, patterns []*regexp.Regexp) interface{} {
+	if value == nil {
+		return value
+	}
+	data, err := json.Marshal(value)
+	if err != nil {
+		return nil
+	}
+	var generic interface{}
+	if err := json.Unmarshal(data, &generic); err != nil {
+		return nil
+	}
+	return redactGeneric(generic, patterns)
+}
+
+func redactGeneric(value interface{}, patterns []*regexp.Regexp) interface{} {
+	switch v := value.(type) {
+	case string:
+		return redact(v, patterns)
+	case []interface{}:
+		for i := range v {
+			v[i] = redactGeneric(v[i], patterns)
+		}
+		return v
+	case map[string]interface{}:
+		for k := range v {
+			v[k] = redactGeneric(v[k], patterns)
+		}
+		return v
+	default:
+		return v
+	}
+}
@@ -0,0 +1,101 @@
+package breaker
+
+import (
+	"sync"
+	"time"
+)
+
+// State 熔断器状态
+type State string
+
+const (
+	Closed   State = "closed"    // 正常放行
+	Open     State = "open"      // 连续失败达到阈值,拒绝请求直至冷却结束
+	HalfOpen State = "half_open" // 冷却结束,放行单个探测请求,成功则恢复,失败则重新熔断
+)
+
+// Breaker 按连续失败次数熔断,threshold<=0 时不熔断
+type Breaker struct {
+	mutex     sync.Mutex
+	threshold int
+	cooldown  time.Duration
+	state     State
+	failures  int
+	openedAt  time.Time
+	probeAt   time.Time // 半开状态下探测请求的放行时间,零值表示尚未放行
+}
+
+func New(threshold int, cooldown time.Duration) *Breaker {
+	return &Breaker{threshold: threshold, cooldown: cooldown, state: Closed}
+}
+
+// Allow 是否放行请求
+func (b *Breaker) Allow() bool {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	now := time.Now()
+	b.refresh(now)
+	switch b.state {
+	case Open:
+		return false
+	case HalfOpen:
+		// 探测请求未上报结果(如被账号限速中断)超过冷却时间后,允许再放行一个
+		if !b.probeAt.IsZero() && now.Sub(b.probeAt) < b.cooldown {
+			return false
+		}
+		b.probeAt = now
+	}
+	return true
+}
+
+// Success 上报成功,恢复为关闭状态
+func (b *Breaker) Success() {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	b.state = Closed
+	b.failures = 0
+	b.probeAt = time.Time{}
+}
+
+// Failure 上报失败,连续失败达到阈值或探测失败时熔断
+func (b *Breaker) Failure() {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	now := time.Now()
+	b.refresh(now)
+	b.failures++
+	if b.threshold <= 0 {
+		return
+	}
+	if b.state == HalfOpen || b.failures >= b.threshold {
+		b.state = Open
+		b.openedAt = now
+		b.probeAt = time.Time{}
+	}
+}
+
+// refresh 冷却结束后由熔断转为半开
+func (b *Breaker) refresh(now time.Time) {
+	if b.state == Open && now.Sub(b.openedAt) >= b.cooldown {
+		b.state = HalfOpen
+	}
+}
+
+// Snapshot 熔断器当前状态
+type Snapshot struct {
+	State               State      `json:"state"`
+	ConsecutiveFailures int        `json:"consecutive_failures"`
+	OpenedAt            *time.Time `json:"opened_at,omitempty"`
+}
+
+func (b *Breaker) Snapshot() Snapshot {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	b.refresh(time.Now())
+	snapshot := Snapshot{State: b.state, ConsecutiveFailures: b.failures}
+	if b.state != Closed {
+		openedAt := b.openedAt
+		snapshot.OpenedAt = &openedAt
+	}
+	return snapshot
+}
@@ -0,0 +1,112 @@
+package breaker
+
+import (
+	"testing"
+	"time"
+)
+
+const testCooldown = 20 * time.Millisecond
+
+func expectState(t *testing.T, b *Breaker, want State) {
+	t.Helper()
+	if got := b.Snapshot().State; got != want {
+		t.Fatalf("state = %s, want %s", got, want)
+	}
+}
+
+func TestTransitions(t *testing.T) {
+	b := New(2, testCooldown)
+	expectState(t, b, Closed)
+
+	b.Failure()
+	expectState(t, b, Closed)
+	if !b.Allow() {
+		t.Fatal("closed breaker should allow")
+	}
+	b.Failure()
+	expectState(t, b, Open)
+	if b.Allow() {
+		t.Fatal("open breaker should reject")
+	}
+	if snapshot := b.Snapshot(); snapshot.ConsecutiveFailures != 2 || snapshot.OpenedAt == nil {
+		t.Fatalf("snapshot = %+v", snapshot)
+	}
+
+	// 冷却结束转为半开,探测失败重新熔断
+	time.Sleep(testCooldown)
+	expectState(t, b, HalfOpen)
+	if !b.Allow() {
+		t.Fatal("half-open breaker should allow a probe")
+	}
+	b.Failure()
+	expectState(t, b, Open)
+	if b.Allow() {
+		t.Fatal("breaker reopened by a failed probe should reject")
+	}
+
+	// 探测成功恢复为关闭
+	time.Sleep(testCooldown)
+	if !b.Allow() {
+		t.Fatal("half-open breaker should allow a probe")
+	}
+	b.Success()
+	expectState(t, b, Closed)
+	if snapshot := b.Snapshot(); snapshot.ConsecutiveFailures != 0 || snapshot.OpenedAt != nil {
+		t.Fatalf("snapshot = %+v", snapshot)
+	}
+}
+
+func TestSuccessResetsFailures(t *testing.T) {
+	b := New(2, testCooldown)
+	b.Failure()
+	b.Success()
+	b.Failure()
+	expectState(t, b, Closed)
+}
+
+func TestHalfOpenAllowsOneProbe(t *testing.T) {
+	b := New(1, time.Hour)
+	b.Failure()
+	// 直接回拨熔断时间,模拟冷却结束
+	b.openedAt = time.Now().Add(-time.Hour)
+	if !b.Allow() {
+		t.Fatal("first probe should be allowed")
+	}
+	for i := 0; i < 3; i++ {
+		if b.Allow() {
+			t.Fatal("only one probe should be allowed while half-open")
+		}
+	}
+}
+
+func TestReprobeAfterUnreportedProbe(t *testing.T) {
+	b := New(1, testCooldown)
+	b.Failure()
+	time.Sleep(testCooldown)
+	if !b.Allow() {
+		t.Fatal("first probe should be allowed")
+	}
+	if b.Allow() {
+		t.Fatal("second probe should wait for the cooldown")
+	}
+	// 探测请求未上报结果,冷却时间后再放行一个
+	time.Sleep(testCooldown)
+	if !b.Allow() {
+		t.Fatal("probe should be allowed again after probeAt + cooldown")
+	}
+	if b.Allow() {
+		t.Fatal("re-probe should again be limited to one")
+	}
+	expectState(t, b, HalfOpen)
+}
+
+func TestZeroThresholdNeverOpens(t *testing.T) {
+	b := New(0, testCooldown)
+	for i := 0; i < 10; i++ {
+		b.Failure()
+	}
+	expectState(t, b, Closed)
+	if !b.Allow() {
+		t.Fatal("breaker without threshold should allow")
+	}
+}
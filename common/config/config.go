@@ -1,11 +1,19 @@
 package config
 
 import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"math/rand"
+	"net/url"
 	"os"
 	"qodo2api/common/env"
+	"qodo2api/common/proxypool"
+	"qodo2api/common/secret"
+	"qodo2api/common/state"
 	google_api "qodo2api/google-api"
 	"strings"
 	"sync"
@@ -15,19 +23,34 @@ import (
 var BackendSecret = os.Getenv("BACKEND_SECRET")
 var QDCookie = os.Getenv("QD_COOKIE")
 var IpBlackList = strings.Split(os.Getenv("IP_BLACK_LIST"), ",")
-var ProxyUrl = env.String("PROXY_URL", "")
+var ProxyUrl = env.String("PROXY_URL", "") // 单个代理,可与 PROXY_URLS 同时使用
+
+// 上游Qodo接口基础地址,可指向mock服务进行离线测试
+var QodoBaseUrl = env.String("QODO_BASE_URL", "https://api.gen.qodo.ai")
 var ChineseChatEnabled = env.Bool("CHINESE_CHAT_ENABLED", true)
 var ApiSecret = os.Getenv("API_SECRET")
 var ApiSecrets = strings.Split(os.Getenv("API_SECRET"), ",")
 
 var RateLimitCookieLockDuration = env.Int("RATE_LIMIT_COOKIE_LOCK_DURATION", 10*60)
 
+// 额度耗尽的账号在共享状态中标记移除的时长(单位:秒),到期后其他实例及重启后的实例可重新使用
+var AccountRemovalDuration = env.Int("ACCOUNT_REMOVAL_DURATION", 24*60*60)
+
 // 隐藏思考过程
 var ReasoningHide = env.Int("REASONING_HIDE", 0)
 
-// 前置message
+// 前置message(JSON数组),插入到历史开头(系统消息之后) 例: [{"role":"user","content":"..."},{"role":"assistant","content":"..."}]
 var PRE_MESSAGES_JSON = env.String("PRE_MESSAGES_JSON", "")
 
+// 全局系统提示词模板,支持 {{.Date}}、{{.Time}}、{{.Model}}、{{.KeyLabel}}
+var SystemPrompt = env.String("SYSTEM_PROMPT", "")
+
+// 客户端已有系统消息时的合并方式[prepend、append、replace、keep]
+var SystemPromptStrategy = env.String("SYSTEM_PROMPT_STRATEGY", "prepend")
+
+// 模型降级链(多条以,分隔) 例: claude-3-7-sonnet->claude-3-5-sonnet->gpt-4o,o1->o3-mini
+var ModelFallbackChains = parseModelFallbackChains(env.String("MODEL_FALLBACK", ""))
+
 // 路由前缀
 var RoutePrefix = env.String("ROUTE_PREFIX", "")
 var SwaggerEnable = os.Getenv("SWAGGER_ENABLE")
@@ -35,40 +58,188 @@ var BackendApiEnable = env.Int("BACKEND_API_ENABLE", 1)
 
 var DebugEnabled = os.Getenv("DEBUG") == "true"
 
-var RateLimitKeyExpirationDuration = 20 * time.Minute
+var (
+	// 日志级别 debug/info/warn/error,未配置时 DEBUG=true 为 debug,否则为 info
+	LogLevel = env.String("LOG_LEVEL", "")
+	// 日志格式 text/json
+	LogFormat = env.String("LOG_FORMAT", "text")
+	// 按包配置日志级别 例: controller=debug,job=warn
+	LogPackageLevels = env.String("LOG_PACKAGE_LEVELS", "")
+	// 日志文件(--log-dir)按天及大小滚动,历史文件按数量及天数清理
+	LogMaxSize    = env.Int("LOG_MAX_SIZE", 100) // MB
+	LogMaxBackups = env.Int("LOG_MAX_BACKUPS", 30)
+	LogMaxAge     = env.Int("LOG_MAX_AGE", 7) // 天
+	LogCompress   = env.Bool("LOG_COMPRESS", false)
+)
 
 var RequestOutTimeDuration = 5 * time.Minute
 
 var (
-	RequestRateLimitNum            = env.Int("REQUEST_RATE_LIMIT", 60)
-	RequestRateLimitDuration int64 = 1 * 60
+	// 限流维度 ip/api_key/user
+	RateLimitKeyBy = env.String("RATE_LIMIT_KEY_BY", "ip")
+	// 每分钟请求数及突发量(突发量为0时等于每分钟请求数)
+	RequestRateLimitNum   = env.Int("REQUEST_RATE_LIMIT", 60)
+	RequestRateLimitBurst = env.Int("REQUEST_RATE_LIMIT_BURST", 0)
+	// 每分钟token数及突发量,为0时不限制
+	TokenRateLimitNum   = env.Int("TOKEN_RATE_LIMIT", 0)
+	TokenRateLimitBurst = env.Int("TOKEN_RATE_LIMIT_BURST", 0)
+	// 限流中间件读取请求体的大小上限(字节),0为不限制
+	MaxRequestBodySize = int64(env.Int("MAX_REQUEST_BODY_SIZE", 32<<20))
+)
+
+func parseModelFallbackChains(value string) map[string][]string {
+	chains := make(map[string][]string)
+	for _, chain := range strings.Split(value, ",") {
+		var models []string
+		for _, m := range strings.Split(chain, "->") {
+			m = strings.TrimSpace(m)
+			if m != "" {
+				models = append(models, m)
+			}
+		}
+		if len(models) > 1 {
+			chains[models[0]] = models[1:]
+		}
+	}
+	return chains
+}
+
+// GetModelFallbackChain 返回请求模型及其降级模型列表,首个元素为请求模型本身
+func GetModelFallbackChain(model string) []string {
+	return append([]string{model}, ModelFallbackChains[model]...)
+}
+
+// 审计日志(JSONL)路径,为空时不记录
+var AuditLogPath = env.String("AUDIT_LOG_PATH", "")
+
+// 审计日志是否记录完整的提示词及回复
+var AuditLogBodies = env.Bool("AUDIT_LOG_BODIES", false)
+
+// 审计日志中提示词及回复的脱敏正则(JSON数组)
+var AuditRedactPatterns, AuditRedactPatternsErr = parseStringListJSON(env.String("AUDIT_REDACT_PATTERNS_JSON",
+	`["sk-[A-Za-z0-9_-]{8,}","Bearer\\s+[A-Za-z0-9._~+/=-]+","[A-Za-z0-9._%+-]+@[A-Za-z0-9.-]+\\.[A-Za-z]{2,}"]`))
+
+var (
+	AuditLogMaxSize    = env.Int("AUDIT_LOG_MAX_SIZE", 100) // MB
+	AuditLogMaxBackups = env.Int("AUDIT_LOG_MAX_BACKUPS", 10)
+	AuditLogMaxAge     = env.Int("AUDIT_LOG_MAX_AGE", 30) // 天
 )
 
-type RateLimitCookie struct {
-	ExpirationTime time.Time // 过期时间
+func parseStringListJSON(value string) ([]string, error) {
+	var list []string
+	if strings.TrimSpace(value) == "" {
+		return list, nil
+	}
+	if err := json.Unmarshal([]byte(value), &list); err != nil {
+		return nil, fmt.Errorf("invalid JSON string list %q: %v", value, err)
+	}
+	return list, nil
 }
 
+// 上游SSE录制目录,设置后每次上游请求的请求体及原始SSE行(含时间)保存为 <请求ID>.json
+var SSERecordDir = env.String("SSE_RECORD_DIR", "")
+
+// 上游SSE回放目录,设置后同时携带 X-Replay-Id 及与 BACKEND_SECRET 一致的 X-Replay-Secret 请求头的请求不访问上游,直接回放对应的录制文件
+var SSEReplayDir = env.String("SSE_REPLAY_DIR", "")
+
+// 回放时是否按录制时的时间间隔输出
+var SSEReplayRealtime = env.Bool("SSE_REPLAY_REALTIME", false)
+
+var (
+	// 链路追踪导出方式 none/otlp,OTLP地址等沿用 OTEL_EXPORTER_OTLP_ENDPOINT 等标准环境变量
+	OtelTracesExporter = env.String("OTEL_TRACES_EXPORTER", "none")
+	OtelServiceName    = env.String("OTEL_SERVICE_NAME", "qodo2api")
+	// 采样比例 0~1
+	OtelTracesSampleRatio = env.Float64("OTEL_TRACES_SAMPLER_ARG", 1)
+)
+
+var (
+	// 收到退出信号后等待进行中请求(含流式响应)结束的最长时间(秒),超时后强制断开
+	ShutdownGracePeriod = env.Int("SHUTDOWN_GRACE_PERIOD", 30)
+	// 标记未就绪后延迟停止接收新请求的时间(秒),留给负载均衡摘除实例
+	ShutdownDelay = env.Int("SHUTDOWN_DELAY", 0)
+)
+
+var (
+	// 上游瞬时失败(网络错误、5xx、首个token前流为空)的最多尝试次数(含首次),同一请求的各降级模型共用
+	RetryMaxAttempts = env.Int("RETRY_MAX_ATTEMPTS", 3)
+	// 首次重试前的等待时间(毫秒),之后每次翻倍并随机抖动
+	RetryBaseDelay = env.Int("RETRY_BASE_DELAY_MS", 500)
+	// 单次等待时间上限(毫秒)
+	RetryMaxDelay = env.Int("RETRY_MAX_DELAY_MS", 5000)
+	// 自首次请求起允许重试的总时长(秒)
+	RetryDeadline = env.Int("RETRY_DEADLINE", 30)
+)
+
 var (
-	rateLimitCookies sync.Map // 使用 sync.Map 管理限速 Cookie
+	// 上游连续失败(请求失败或503)达到该次数后熔断,0为不熔断
+	CircuitBreakerThreshold = env.Int("CIRCUIT_BREAKER_THRESHOLD", 5)
+	// 熔断后的冷却时间(秒),之后放行单个探测请求
+	CircuitBreakerCooldown = env.Int("CIRCUIT_BREAKER_COOLDOWN", 30)
 )
 
+var (
+	// 上游连接池: 同一代理及TLS指纹的请求复用连接,每个上游地址保留的HTTP/1.1空闲连接数
+	TLSPoolMaxIdleConnsPerHost = env.Int("TLS_POOL_MAX_IDLE_CONNS_PER_HOST", 4)
+	// 空闲连接超时(秒)
+	TLSPoolIdleTimeout = env.Int("TLS_POOL_IDLE_TIMEOUT", 90)
+	// 最多保留的连接组数量(按代理、JA3、UA区分)
+	TLSPoolMaxTransports = env.Int("TLS_POOL_MAX_TRANSPORTS", 64)
+)
+
+// 状态后端[memory:进程内存、redis:多实例共享账号状态、token缓存及限流计数]
+var StateBackend = env.String("STATE_BACKEND", "memory")
+var RedisUrl = env.String("REDIS_URL", "")
+var RedisKeyPrefix = env.String("REDIS_KEY_PREFIX", "qodo2api:")
+
+// InitStateBackend 按 STATE_BACKEND 初始化状态后端,需在 InitQDCookies 之前调用
+func InitStateBackend() error {
+	switch StateBackend {
+	case "", "memory":
+		return nil
+	case "redis":
+		backend, err := state.NewRedisBackendFromURL(RedisUrl, RedisKeyPrefix)
+		if err != nil {
+			return fmt.Errorf("failed to connect redis: %v", err)
+		}
+		state.SetDefault(backend)
+		return nil
+	default:
+		return fmt.Errorf("unsupported STATE_BACKEND: %s", StateBackend)
+	}
+}
+
+// hashKey 状态后端中以哈希代替cookie、API-KEY等敏感值作为key
+func hashKey(value string) string {
+	sum := sha256.Sum256([]byte(value))
+	return hex.EncodeToString(sum[:16])
+}
+
 func AddRateLimitCookie(cookie string, expirationTime time.Time) {
-	rateLimitCookies.Store(cookie, RateLimitCookie{
-		ExpirationTime: expirationTime,
-	})
-	//fmt.Printf("Storing cookie: %s with value: %+v\n", cookie, RateLimitCookie{ExpirationTime: expirationTime})
+	_ = state.Default().LockAccount(context.Background(), hashKey(cookie), expirationTime)
+}
+
+type QDTokenInfo = state.Token
+
+// GetQDTokenInfo 获取 cookie 对应账号的token信息,= 前的apiKey为各账号共用,按完整cookie区分账号
+func GetQDTokenInfo(cookie string) (QDTokenInfo, bool) {
+	tokenInfo, ok, err := state.Default().GetToken(context.Background(), hashKey(cookie))
+	if err != nil {
+		return tokenInfo, false
+	}
+	return tokenInfo, ok
 }
 
-type QDTokenInfo struct {
-	ApiKey       string
-	RefreshToken string
-	AccessToken  string
+// SetQDTokenInfo 更新 cookie 对应账号的token信息
+func SetQDTokenInfo(cookie string, tokenInfo QDTokenInfo) error {
+	secret.Register(tokenInfo.ApiKey, tokenInfo.RefreshToken)
+	return state.Default().SetToken(context.Background(), hashKey(cookie), tokenInfo)
 }
 
 var (
-	QDTokenMap   = map[string]QDTokenInfo{}
-	QDCookies    []string   // 存储所有的 cookies
-	cookiesMutex sync.Mutex // 保护 QDCookies 的互斥锁
+	QDCookies         []string   // 存储所有的 cookies
+	configuredCookies int        // 启动时配置的 cookie 数量
+	cookiesMutex      sync.Mutex // 保护 QDCookies 的互斥锁
 )
 
 func InitQDCookies() ([]string, error) {
@@ -85,25 +256,36 @@ func InitQDCookies() ([]string, error) {
 			cookie = strings.TrimSpace(cookie)
 			split := strings.Split(cookie, "=")
 			if len(split) != 2 {
-				return nil, fmt.Errorf("invalid cookie format: %s", cookie)
+				return nil, fmt.Errorf("invalid cookie format: %s", secret.MaskCookie(cookie))
 			}
+			secret.Register(cookie, split[0], split[1])
 			request := google_api.RefreshTokenRequest{
 				Key:          split[0],
 				RefreshToken: split[1],
+				Proxy:        proxypool.Get(cookie),
+				Profile:      SelectTLSProfile(cookie),
 			}
 
-			response, err := google_api.GetFirebaseToken(request)
+			response, err := google_api.GetFirebaseToken(context.Background(), request)
+			if err != nil && SSEReplayDir != "" {
+				// 回放模式下允许离线启动,回放请求不需要access token
+				response, err = &google_api.TokenResponse{RefreshToken: split[1]}, nil
+			}
 			if err != nil {
-				return nil, fmt.Errorf("GetFirebaseToken err %v , Req: %v", err, request)
+				return nil, fmt.Errorf("GetFirebaseToken err %v , Cookie: %s", err, secret.MaskCookie(cookie))
 			}
-			QDTokenMap[split[0]] = QDTokenInfo{
+			err = SetQDTokenInfo(cookie, QDTokenInfo{
 				ApiKey:       split[0],
 				RefreshToken: response.RefreshToken,
 				AccessToken:  response.AccessToken,
+			})
+			if err != nil {
+				return nil, fmt.Errorf("SetQDTokenInfo err %v", err)
 			}
 			QDCookies = append(QDCookies, cookie)
 		}
 	}
+	configuredCookies = len(QDCookies)
 	return QDCookies, nil
 }
 
@@ -133,19 +315,12 @@ func NewCookieManager() *CookieManager {
 			continue // 忽略空字符串
 		}
 
-		// 检查是否在 RateLimitCookies 中
-		if value, ok := rateLimitCookies.Load(cookie); ok {
-			rateLimitCookie, ok := value.(RateLimitCookie) // 正确转换为 RateLimitCookie
-			if !ok {
-				continue
-			}
-			if rateLimitCookie.ExpirationTime.After(time.Now()) {
-				// 如果未过期，忽略该 cookie
-				continue
-			} else {
-				// 如果已过期，从 RateLimitCookies 中删除
-				rateLimitCookies.Delete(cookie)
-			}
+		// 忽略已被(其他实例)移除或限速未过期的 cookie
+		if removed, _ := state.Default().IsAccountRemoved(context.Background(), hashKey(cookie)); removed {
+			continue
+		}
+		if _, locked, _ := state.Default().GetAccountLock(context.Background(), hashKey(cookie)); locked {
+			continue
 		}
 
 		// 添加到有效 cookie 列表
@@ -158,6 +333,35 @@ func NewCookieManager() *CookieManager {
 	}
 }
 
+// AccountStats 各状态的账号数量
+type AccountStats struct {
+	Total       int `json:"total"`
+	Active      int `json:"active"`
+	RateLimited int `json:"rate_limited"`
+	Removed     int `json:"removed"`
+}
+
+// GetAccountStats 统计配置的账号中可用、限速锁定及已移除(额度耗尽)的数量
+func GetAccountStats() AccountStats {
+	cookiesMutex.Lock()
+	stats := AccountStats{Total: configuredCookies}
+	cookies := GetQDCookies()
+	cookiesMutex.Unlock()
+
+	for _, cookie := range cookies {
+		if removed, _ := state.Default().IsAccountRemoved(context.Background(), hashKey(cookie)); removed {
+			continue
+		}
+		if _, locked, _ := state.Default().GetAccountLock(context.Background(), hashKey(cookie)); locked {
+			stats.RateLimited++
+			continue
+		}
+		stats.Active++
+	}
+	stats.Removed = stats.Total - stats.Active - stats.RateLimited
+	return stats
+}
+
 func (cm *CookieManager) GetRandomCookie() (string, error) {
 	cm.mu.Lock()
 	defer cm.mu.Unlock()
@@ -201,4 +405,23 @@ func RemoveCookie(cookieToRemove string) {
 
 	// 更新 GSCookies
 	QDCookies = newCookies
+
+	// 同步给共享同一状态后端的其他实例
+	until := time.Now().Add(time.Duration(AccountRemovalDuration) * time.Second)
+	_ = state.Default().RemoveAccount(context.Background(), hashKey(cookieToRemove), until)
+}
+
+// 登记配置中的密钥,日志及返回给客户端的错误信息中均会隐藏
+func init() {
+	secret.Register(BackendSecret)
+	secret.Register(ApiSecrets...)
+	for key := range ApiKeyPolicies {
+		secret.Register(key)
+	}
+	for _, rawUrl := range append([]string{RedisUrl}, ProxyUrls...) {
+		if u, err := url.Parse(rawUrl); err == nil && u.User != nil {
+			password, _ := u.User.Password()
+			secret.Register(password)
+		}
+	}
 }
@@ -0,0 +1,148 @@
+package config
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"qodo2api/common/env"
+	"qodo2api/common/state"
+	"qodo2api/common/transform"
+	"strings"
+	"time"
+)
+
+// ApiKeyPolicy 单个API-KEY的访问策略,数值为0表示不限制
+type ApiKeyPolicy struct {
+	Label                string   `json:"label"`
+	Models               []string `json:"models"`
+	RequestsPerMinute    int      `json:"rpm"`
+	DailyTokenQuota      int      `json:"daily_tokens"`
+	MaxConcurrentStreams int      `json:"max_concurrent_streams"`
+	ExpiresAt            string   `json:"expires_at"`
+	// 请求转换管道,配置后(包括空数组)替代按模型配置的管道
+	Transformers []transform.Spec `json:"transformers"`
+
+	expiresAt time.Time
+	pipeline  transform.Pipeline
+}
+
+// API-KEY策略 例: {"sk-team-a":{"label":"team-a","models":["gpt-4o"],"rpm":60,"daily_tokens":1000000,"max_concurrent_streams":2,"expires_at":"2025-12-31","transformers":["url_encode"]}}
+var ApiKeyPolicies, ApiKeyPoliciesErr = parseApiKeyPolicies(env.String("API_KEY_POLICIES_JSON", ""))
+
+func parseApiKeyPolicies(value string) (map[string]*ApiKeyPolicy, error) {
+	policies := make(map[string]*ApiKeyPolicy)
+	if strings.TrimSpace(value) == "" {
+		return policies, nil
+	}
+	if err := json.Unmarshal([]byte(value), &policies); err != nil {
+		return policies, fmt.Errorf("invalid API_KEY_POLICIES_JSON: %v", err)
+	}
+	for key, policy := range policies {
+		if policy == nil {
+			return policies, fmt.Errorf("invalid API_KEY_POLICIES_JSON: empty policy for key %s", policy.keyLabel(key))
+		}
+		if policy.Transformers != nil {
+			pipeline, err := transform.Build(policy.Transformers)
+			if err != nil {
+				return policies, fmt.Errorf("invalid transformers for key %s: %v", policy.keyLabel(key), err)
+			}
+			policy.pipeline = pipeline
+		}
+		if policy.ExpiresAt == "" {
+			continue
+		}
+		expiresAt, err := parsePolicyExpiry(policy.ExpiresAt)
+		if err != nil {
+			return policies, fmt.Errorf("invalid expires_at for key %s: %v", policy.keyLabel(key), err)
+		}
+		policy.expiresAt = expiresAt
+	}
+	return policies, nil
+}
+
+// parsePolicyExpiry 支持RFC3339时间及日期,仅日期时当天全天有效
+func parsePolicyExpiry(value string) (time.Time, error) {
+	if t, err := time.Parse(time.RFC3339, value); err == nil {
+		return t, nil
+	}
+	t, err := time.ParseInLocation("2006-01-02", value, time.Local)
+	if err != nil {
+		return time.Time{}, err
+	}
+	return t.AddDate(0, 0, 1), nil
+}
+
+func (p *ApiKeyPolicy) keyLabel(key string) string {
+	if p != nil && p.Label != "" {
+		return p.Label
+	}
+	if len(key) > 6 {
+		return key[:6] + "***"
+	}
+	return "***"
+}
+
+// GetApiKeyPolicy 获取API-KEY对应的策略
+func GetApiKeyPolicy(key string) (*ApiKeyPolicy, bool) {
+	policy, ok := ApiKeyPolicies[key]
+	return policy, ok
+}
+
+// TransformPipeline 策略配置的请求转换管道,未配置时返回false
+func (p *ApiKeyPolicy) TransformPipeline() (transform.Pipeline, bool) {
+	return p.pipeline, p.Transformers != nil
+}
+
+// Expired 策略是否已过期
+func (p *ApiKeyPolicy) Expired() bool {
+	return !p.expiresAt.IsZero() && time.Now().After(p.expiresAt)
+}
+
+// AllowsModel 模型是否在允许列表内,未配置列表时允许全部模型
+func (p *ApiKeyPolicy) AllowsModel(model string) bool {
+	if len(p.Models) == 0 {
+		return true
+	}
+	for _, m := range p.Models {
+		if m == model || m == "*" {
+			return true
+		}
+	}
+	return false
+}
+
+// apiKeyStreamsTTL 并发流计数的过期时间,防止实例异常退出后计数无法释放
+const apiKeyStreamsTTL = time.Hour
+
+// AddApiKeyTokenUsage 累加API-KEY当日消耗的token数
+func AddApiKeyTokenUsage(key string, tokens int) {
+	_, _ = state.Default().IncrCounter(context.Background(), apiKeyTokenUsageKey(key), int64(tokens), 48*time.Hour)
+}
+
+// GetApiKeyTokenUsage 获取API-KEY当日消耗的token数
+func GetApiKeyTokenUsage(key string) int {
+	tokens, _ := state.Default().GetCounter(context.Background(), apiKeyTokenUsageKey(key))
+	return int(tokens)
+}
+
+func apiKeyTokenUsageKey(key string) string {
+	return "quota:" + hashKey(key) + ":" + time.Now().Format("20060102")
+}
+
+// AcquireApiKeyStream 占用一个并发流名额,超过上限时返回false
+func AcquireApiKeyStream(key string, max int) bool {
+	streams, err := state.Default().IncrCounter(context.Background(), "streams:"+hashKey(key), 1, apiKeyStreamsTTL)
+	if err != nil {
+		return true
+	}
+	if max > 0 && streams > int64(max) {
+		ReleaseApiKeyStream(key)
+		return false
+	}
+	return true
+}
+
+// ReleaseApiKeyStream 释放并发流名额
+func ReleaseApiKeyStream(key string) {
+	_, _ = state.Default().IncrCounter(context.Background(), "streams:"+hashKey(key), -1, apiKeyStreamsTTL)
+}
@@ -0,0 +1,65 @@
+package config
+
+import (
+	"fmt"
+	"hash/fnv"
+	"math/rand"
+	"qodo2api/common/env"
+	"qodo2api/cycletls"
+	"strings"
+	"sync/atomic"
+)
+
+// 上游指纹选择策略
+const (
+	TLSProfileStrategyAccount    = "account"     // 按账号固定使用其中一个指纹
+	TLSProfileStrategyRandom     = "random"      // 每次请求随机选择
+	TLSProfileStrategyRoundRobin = "round_robin" // 每次请求轮流使用
+)
+
+// 上游请求使用的客户端指纹(TLS、HTTP/2、请求头顺序及UA),多个以逗号分隔,可选: node、vscode、chrome
+var TLSProfiles, TLSProfilesErr = parseTLSProfiles(env.String("TLS_PROFILES", cycletls.ProfileNode))
+
+// 多个指纹时的选择策略[account、random、round_robin]
+var TLSProfileStrategy = env.String("TLS_PROFILE_STRATEGY", TLSProfileStrategyAccount)
+
+func parseTLSProfiles(value string) ([]cycletls.Profile, error) {
+	var result []cycletls.Profile
+	for _, name := range strings.Split(value, ",") {
+		name = strings.TrimSpace(name)
+		if name == "" {
+			continue
+		}
+		profile, ok := cycletls.LookupProfile(name)
+		if !ok {
+			return nil, fmt.Errorf("invalid TLS_PROFILES: unknown profile %s, available: %s", name, strings.Join(cycletls.ProfileNames(), ","))
+		}
+		result = append(result, profile)
+	}
+	if len(result) == 0 {
+		profile, _ := cycletls.LookupProfile(cycletls.ProfileNode)
+		result = append(result, profile)
+	}
+	return result, nil
+}
+
+var profileCursor atomic.Uint64
+
+// SelectTLSProfile 按 TLS_PROFILE_STRATEGY 为本次请求选择客户端指纹,聊天及token刷新共用,account 为账号cookie(= 前的apiKey为各账号共用)
+func SelectTLSProfile(account string) cycletls.Profile {
+	profiles := TLSProfiles
+	if len(profiles) == 1 {
+		return profiles[0]
+	}
+	switch TLSProfileStrategy {
+	case TLSProfileStrategyRandom:
+		return profiles[rand.Intn(len(profiles))]
+	case TLSProfileStrategyRoundRobin:
+		return profiles[(profileCursor.Add(1)-1)%uint64(len(profiles))]
+	default:
+		// 同一账号始终使用同一指纹,避免账号在不同客户端特征间切换
+		h := fnv.New32a()
+		h.Write([]byte(account))
+		return profiles[h.Sum32()%uint32(len(profiles))]
+	}
+}
@@ -0,0 +1,102 @@
+package config
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/url"
+	"qodo2api/common/env"
+	"strconv"
+	"strings"
+)
+
+// 代理池: PROXY_URL 与 PROXY_URLS(逗号分隔)合并去重,支持 http、https、socks5(h)
+var ProxyUrls, ProxyUrlsErr = parseProxyUrls(ProxyUrl, env.String("PROXY_URLS", ""))
+
+// 账号固定使用的代理,key为账号在 QD_COOKIE 中的序号(从1开始),值为代理地址或其在代理池中的序号(从1开始) 例: {"1":"2","2":"socks5://127.0.0.1:1080"}
+// 解析后以账号cookie为key
+var ProxyBindings, ProxyBindingsErr = parseProxyBindings(env.String("PROXY_BINDINGS_JSON", ""), ProxyUrls, strings.Split(QDCookie, ","))
+
+var (
+	// 代理健康检查间隔(秒),0为不检查
+	ProxyHealthCheckInterval = env.Int("PROXY_HEALTH_CHECK_INTERVAL", 60)
+	// 单次健康检查超时(秒)
+	ProxyHealthCheckTimeout = env.Int("PROXY_HEALTH_CHECK_TIMEOUT", 10)
+	// 连续失败达到该次数后摘除代理,0为不摘除
+	ProxyMaxFailures = env.Int("PROXY_MAX_FAILURES", 3)
+)
+
+func parseProxyUrls(values ...string) ([]string, error) {
+	var result []string
+	seen := make(map[string]bool)
+	for _, value := range values {
+		for _, rawUrl := range strings.Split(value, ",") {
+			rawUrl = strings.TrimSpace(rawUrl)
+			if rawUrl == "" || seen[rawUrl] {
+				continue
+			}
+			u, err := url.Parse(rawUrl)
+			if err != nil || u.Host == "" {
+				return nil, fmt.Errorf("invalid PROXY_URLS: entry %d is not a valid url", len(result)+1)
+			}
+			switch u.Scheme {
+			case "http", "https", "socks5", "socks5h", "socks4":
+			default:
+				return nil, fmt.Errorf("invalid PROXY_URLS: unsupported scheme %s", u.Scheme)
+			}
+			seen[rawUrl] = true
+			result = append(result, rawUrl)
+		}
+	}
+	return result, nil
+}
+
+func parseProxyBindings(value string, proxies []string, cookies []string) (map[string]string, error) {
+	bindings := make(map[string]string)
+	if strings.TrimSpace(value) == "" {
+		return bindings, nil
+	}
+	var raw map[string]string
+	if err := json.Unmarshal([]byte(value), &raw); err != nil {
+		return bindings, fmt.Errorf("invalid PROXY_BINDINGS_JSON: %v", err)
+	}
+	for account, proxy := range raw {
+		n, err := strconv.Atoi(strings.TrimSpace(account))
+		if err != nil || n < 1 || n > len(cookies) || strings.TrimSpace(cookies[n-1]) == "" {
+			return bindings, fmt.Errorf("invalid PROXY_BINDINGS_JSON: account %q is not a position in QD_COOKIE", account)
+		}
+		cookie := strings.TrimSpace(cookies[n-1])
+		proxy = strings.TrimSpace(proxy)
+		if n, err := strconv.Atoi(proxy); err == nil {
+			if n < 1 || n > len(proxies) {
+				return bindings, fmt.Errorf("invalid PROXY_BINDINGS_JSON: proxy index %d out of range 1-%d", n, len(proxies))
+			}
+			proxy = proxies[n-1]
+		}
+		found := false
+		for _, p := range proxies {
+			found = found || p == proxy
+		}
+		if !found {
+			return bindings, fmt.Errorf("invalid PROXY_BINDINGS_JSON: proxy for account %d is not in PROXY_URLS", n)
+		}
+		bindings[cookie] = proxy
+	}
+	return bindings, nil
+}
+
+// QodoBaseAddr 上游地址(host:port),用于代理健康检查
+func QodoBaseAddr() string {
+	u, err := url.Parse(QodoBaseUrl)
+	if err != nil || u.Hostname() == "" {
+		return "api.gen.qodo.ai:443"
+	}
+	if u.Port() != "" {
+		return u.Host
+	}
+	port := "443"
+	if u.Scheme == "http" {
+		port = "80"
+	}
+	return net.JoinHostPort(u.Hostname(), port)
+}
@@ -0,0 +1,69 @@
+package config
+
+import (
+	"encoding/json"
+	"fmt"
+	"qodo2api/common/env"
+	"qodo2api/common/transform"
+	"strings"
+)
+
+// 全局请求转换管道(SYSTEM_PROMPT、PRE_MESSAGES_JSON),在按模型或API-KEY配置的管道之前执行
+var GlobalTransformPipeline, GlobalTransformPipelineErr = buildGlobalTransformPipeline(SystemPrompt, SystemPromptStrategy, PRE_MESSAGES_JSON)
+
+func buildGlobalTransformPipeline(prompt, strategy, preMessages string) (transform.Pipeline, error) {
+	var specs []transform.Spec
+	if prompt != "" {
+		specs = append(specs, transform.Spec{Name: transform.NameSystemPrompt, Prompt: prompt, Strategy: strategy})
+	}
+	if strings.TrimSpace(preMessages) != "" {
+		var messages []transform.Message
+		if err := json.Unmarshal([]byte(preMessages), &messages); err != nil {
+			return nil, fmt.Errorf("invalid PRE_MESSAGES_JSON: %v", err)
+		}
+		if len(messages) > 0 {
+			specs = append(specs, transform.Spec{Name: transform.NamePrefixMessages, Messages: messages})
+		}
+	}
+	pipeline, err := transform.Build(specs)
+	if err != nil {
+		return nil, fmt.Errorf("invalid SYSTEM_PROMPT: %v", err)
+	}
+	return pipeline, nil
+}
+
+// 按模型配置的请求转换管道,"*"为未单独配置的模型共用 例: {"*":["chinese_mode"],"gpt-4o":[{"name":"system_prompt","prompt":"Be concise."}]}
+var TransformPipelines, TransformPipelinesErr = parseTransformPipelines(env.String("TRANSFORMERS_JSON", ""))
+
+func parseTransformPipelines(value string) (map[string]transform.Pipeline, error) {
+	pipelines := make(map[string]transform.Pipeline)
+	if strings.TrimSpace(value) == "" {
+		return pipelines, nil
+	}
+	var specs map[string][]transform.Spec
+	if err := json.Unmarshal([]byte(value), &specs); err != nil {
+		return pipelines, fmt.Errorf("invalid TRANSFORMERS_JSON: %v", err)
+	}
+	for model, list := range specs {
+		pipeline, err := transform.Build(list)
+		if err != nil {
+			return pipelines, fmt.Errorf("invalid TRANSFORMERS_JSON for model %s: %v", model, err)
+		}
+		pipelines[model] = pipeline
+	}
+	return pipelines, nil
+}
+
+// GetTransformPipeline 获取模型的请求转换管道,未配置时按 CHINESE_CHAT_ENABLED 决定是否启用中文模式
+func GetTransformPipeline(model string) transform.Pipeline {
+	if pipeline, ok := TransformPipelines[model]; ok {
+		return pipeline
+	}
+	if pipeline, ok := TransformPipelines["*"]; ok {
+		return pipeline
+	}
+	if ChineseChatEnabled {
+		return transform.ChineseMode()
+	}
+	return nil
+}
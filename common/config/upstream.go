@@ -0,0 +1,18 @@
+package config
+
+import (
+	"fmt"
+	"qodo2api/common/env"
+	"qodo2api/common/upstreamerr"
+)
+
+// 上游错误分类规则(JSON数组),优先于内置规则匹配 例: [{"class":"rate_limit","status":400,"message":"(?i)slow down"}]
+var UpstreamErrorRules, UpstreamErrorRulesErr = parseUpstreamErrorRules(env.String("UPSTREAM_ERROR_RULES_JSON", ""))
+
+func parseUpstreamErrorRules(value string) ([]upstreamerr.Rule, error) {
+	rules, err := upstreamerr.ParseRules(value)
+	if err != nil {
+		return nil, fmt.Errorf("invalid UPSTREAM_ERROR_RULES_JSON: %v", err)
+	}
+	return rules, nil
+}
@@ -1,5 +1,9 @@
 package helper
 
 const (
-	RequestIdKey = "X-Request-Id"
+	RequestIdKey    = "X-Request-Id"
+	ApiKeyKey       = "ApiKey"
+	ApiKeyPolicyKey = "ApiKeyPolicy"
+	AuditRecordKey  = "AuditRecord"
+	ErrorClassKey   = "ErrorClass"
 )
@@ -6,6 +6,7 @@ import (
 	"log"
 	"os"
 	"path/filepath"
+	"testing"
 )
 
 var (
@@ -26,7 +27,10 @@ func printHelp() {
 }
 
 func init() {
-	flag.Parse()
+	// 测试二进制的参数由 testing 解析
+	if !testing.Testing() {
+		flag.Parse()
+	}
 
 	if *PrintVersion {
 		fmt.Println(Version)
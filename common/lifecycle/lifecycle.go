@@ -0,0 +1,33 @@
+package lifecycle
+
+import "sync/atomic"
+
+var (
+	ready    atomic.Bool
+	inFlight atomic.Int64
+)
+
+// SetReady 设置服务是否就绪,关闭时先置为未就绪,使负载均衡不再转发新请求
+func SetReady(value bool) {
+	ready.Store(value)
+}
+
+// Ready 服务是否就绪
+func Ready() bool {
+	return ready.Load()
+}
+
+// RequestStarted 记录一个进行中的请求
+func RequestStarted() {
+	inFlight.Add(1)
+}
+
+// RequestFinished 进行中的请求结束
+func RequestFinished() {
+	inFlight.Add(-1)
+}
+
+// InFlight 进行中的请求数(含未结束的流式响应)
+func InFlight() int64 {
+	return inFlight.Load()
+}
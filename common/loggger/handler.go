@@ -0,0 +1,196 @@
+package logger
+
+import (
+	"context"
+	"log/slog"
+	"qodo2api/common/config"
+	"qodo2api/common/secret"
+	"runtime"
+	"strings"
+	"sync"
+
+	"github.com/gin-gonic/gin"
+)
+
+const modulePrefix = "qodo2api/"
+
+type contextKey string
+
+const (
+	modelKey   contextKey = "model"
+	accountKey contextKey = "account"
+)
+
+// WithModel 在ctx中记录本次请求实际使用的模型,之后的日志均携带 model 字段
+func WithModel(ctx context.Context, model string) context.Context {
+	return context.WithValue(ctx, modelKey, model)
+}
+
+// WithAccount 在ctx中记录脱敏后的账号,之后的日志均携带 account 字段
+func WithAccount(ctx context.Context, cookie string) context.Context {
+	return context.WithValue(ctx, accountKey, secret.MaskCookie(cookie))
+}
+
+// contextAttrs 从ctx中取出请求ID、模型及账号字段
+func contextAttrs(ctx context.Context) []slog.Attr {
+	if c, ok := ctx.(*gin.Context); ok && c.Request != nil {
+		ctx = c.Request.Context()
+	}
+	var attrs []slog.Attr
+	if id := requestIdFromContext(ctx); id != "" {
+		attrs = append(attrs, slog.String("request_id", id))
+	}
+	if model, ok := ctx.Value(modelKey).(string); ok && model != "" {
+		attrs = append(attrs, slog.String("model", model))
+	}
+	if account, ok := ctx.Value(accountKey).(string); ok && account != "" {
+		attrs = append(attrs, slog.String("account", account))
+	}
+	return attrs
+}
+
+// handler 按调用方所在包过滤级别,附加ctx中的字段,并按级别选择输出
+type handler struct {
+	out    slog.Handler
+	errOut slog.Handler
+	levels *levels
+}
+
+func (h *handler) Enabled(_ context.Context, level slog.Level) bool {
+	return level >= h.levels.min
+}
+
+func (h *handler) Handle(ctx context.Context, r slog.Record) error {
+	if r.Level < h.levels.forPC(r.PC) {
+		return nil
+	}
+	r = redactRecord(r)
+	r.AddAttrs(contextAttrs(ctx)...)
+	if r.Level >= slog.LevelWarn {
+		return h.errOut.Handle(ctx, r)
+	}
+	return h.out.Handle(ctx, r)
+}
+
+// redactRecord 隐藏日志消息及字符串字段中的密钥
+func redactRecord(r slog.Record) slog.Record {
+	redacted := slog.NewRecord(r.Time, r.Level, secret.Redact(r.Message), r.PC)
+	r.Attrs(func(attr slog.Attr) bool {
+		redacted.AddAttrs(redactAttr(attr))
+		return true
+	})
+	return redacted
+}
+
+func redactAttr(attr slog.Attr) slog.Attr {
+	switch attr.Value.Kind() {
+	case slog.KindString:
+		return slog.String(attr.Key, secret.Redact(attr.Value.String()))
+	case slog.KindGroup:
+		attrs := attr.Value.Group()
+		redacted := make([]any, 0, len(attrs))
+		for _, a := range attrs {
+			redacted = append(redacted, redactAttr(a))
+		}
+		return slog.Group(attr.Key, redacted...)
+	case slog.KindAny:
+		if err, ok := attr.Value.Any().(error); ok {
+			return slog.String(attr.Key, secret.Redact(err.Error()))
+		}
+	}
+	return attr
+}
+
+func (h *handler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	redacted := make([]slog.Attr, len(attrs))
+	for i, attr := range attrs {
+		redacted[i] = redactAttr(attr)
+	}
+	return &handler{out: h.out.WithAttrs(redacted), errOut: h.errOut.WithAttrs(redacted), levels: h.levels}
+}
+
+func (h *handler) WithGroup(name string) slog.Handler {
+	return &handler{out: h.out.WithGroup(name), errOut: h.errOut.WithGroup(name), levels: h.levels}
+}
+
+// levels 全局级别及按包配置的级别,包名为模块内的相对路径,如 controller、common/config
+type levels struct {
+	global   slog.Level
+	packages map[string]slog.Level
+	min      slog.Level
+	cache    sync.Map // pc -> slog.Level
+}
+
+// parseLevels 解析 LOG_LEVEL 及 LOG_PACKAGE_LEVELS(例: controller=debug,job=warn)
+func parseLevels(global string, packages string) *levels {
+	l := &levels{global: parseLevel(global, slog.LevelInfo), packages: make(map[string]slog.Level)}
+	if global == "" && config.DebugEnabled {
+		l.global = slog.LevelDebug
+	}
+	l.min = l.global
+	for _, item := range strings.Split(packages, ",") {
+		pkg, level, ok := strings.Cut(strings.TrimSpace(item), "=")
+		if !ok || strings.TrimSpace(pkg) == "" {
+			continue
+		}
+		lv := parseLevel(strings.TrimSpace(level), l.global)
+		l.packages[strings.Trim(strings.TrimSpace(pkg), "/")] = lv
+		if lv < l.min {
+			l.min = lv
+		}
+	}
+	return l
+}
+
+func parseLevel(value string, defaultLevel slog.Level) slog.Level {
+	switch strings.ToLower(value) {
+	case "debug":
+		return slog.LevelDebug
+	case "info":
+		return slog.LevelInfo
+	case "warn", "warning":
+		return slog.LevelWarn
+	case "error":
+		return slog.LevelError
+	default:
+		return defaultLevel
+	}
+}
+
+// forPC 返回调用方所在包的级别,按最长前缀匹配
+func (l *levels) forPC(pc uintptr) slog.Level {
+	if len(l.packages) == 0 || pc == 0 {
+		return l.global
+	}
+	if level, ok := l.cache.Load(pc); ok {
+		return level.(slog.Level)
+	}
+	pkg := packageOf(pc)
+	level, matched := l.global, ""
+	for prefix, lv := range l.packages {
+		if (pkg == prefix || strings.HasPrefix(pkg, prefix+"/")) && len(prefix) > len(matched) {
+			level, matched = lv, prefix
+		}
+	}
+	l.cache.Store(pc, level)
+	return level
+}
+
+// packageOf 由函数名(如 qodo2api/controller.ChatForOpenAI.func1)得到模块内的包路径
+func packageOf(pc uintptr) string {
+	frames := runtime.CallersFrames([]uintptr{pc})
+	frame, _ := frames.Next()
+	name := frame.Function
+	slash := strings.LastIndex(name, "/")
+	if dot := strings.Index(name[slash+1:], "."); dot >= 0 {
+		name = name[:slash+1+dot]
+	}
+	return strings.TrimPrefix(name, modulePrefix)
+}
+
+// callerPC 跳过日志函数自身,返回业务调用方的pc
+func callerPC(skip int) uintptr {
+	var pcs [1]uintptr
+	runtime.Callers(skip+1, pcs[:])
+	return pcs[0]
+}
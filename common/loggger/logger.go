@@ -5,99 +5,131 @@ import (
 	"fmt"
 	"io"
 	"log"
+	"log/slog"
 	"os"
 	"path/filepath"
 	"qodo2api/common/config"
 	"qodo2api/common/helper"
+	"qodo2api/common/rotatefile"
 	"sync"
 	"time"
 
 	"github.com/gin-gonic/gin"
 )
 
-const (
-	loggerDEBUG = "DEBUG"
-	loggerINFO  = "INFO"
-	loggerWarn  = "WARN"
-	loggerError = "ERR"
-)
-
 var setupLogOnce sync.Once
 
+var defaultLogger = newLogger(os.Stdout, os.Stderr)
+
+// SetupLogger 按 LogDir 额外输出到按大小及日期滚动的日志文件,并按配置重建日志输出
 func SetupLogger() {
 	setupLogOnce.Do(func() {
 		if LogDir != "" {
-			logPath := filepath.Join(LogDir, fmt.Sprintf("qodo2api-%s.log", time.Now().Format("20060102")))
-			fd, err := os.OpenFile(logPath, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+			fd, err := rotatefile.New(filepath.Join(LogDir, "qodo2api.log"), rotatefile.Options{
+				MaxSize:    int64(config.LogMaxSize) * 1024 * 1024,
+				MaxBackups: config.LogMaxBackups,
+				MaxAge:     time.Duration(config.LogMaxAge) * 24 * time.Hour,
+				Daily:      true,
+				Compress:   config.LogCompress,
+			})
 			if err != nil {
-				log.Fatal("failed to open log file")
+				log.Fatalf("failed to open log file: %v", err)
 			}
 			gin.DefaultWriter = io.MultiWriter(os.Stdout, fd)
 			gin.DefaultErrorWriter = io.MultiWriter(os.Stderr, fd)
 		}
+		defaultLogger = newLogger(gin.DefaultWriter, gin.DefaultErrorWriter)
+	})
+}
+
+// newLogger DEBUG/INFO 写入 out, WARN 及以上写入 errOut
+func newLogger(out io.Writer, errOut io.Writer) *slog.Logger {
+	levels := parseLevels(config.LogLevel, config.LogPackageLevels)
+	return slog.New(&handler{
+		out:    newFormatHandler(out),
+		errOut: newFormatHandler(errOut),
+		levels: levels,
 	})
 }
 
+func newFormatHandler(w io.Writer) slog.Handler {
+	options := &slog.HandlerOptions{Level: slog.LevelDebug}
+	if config.LogFormat == "json" {
+		return slog.NewJSONHandler(w, options)
+	}
+	return slog.NewTextHandler(w, options)
+}
+
+// Logger 返回底层的 slog.Logger,用于需要自定义属性的场景
+func Logger() *slog.Logger {
+	return defaultLogger
+}
+
 func SysLog(s string) {
-	t := time.Now()
-	_, _ = fmt.Fprintf(gin.DefaultWriter, "[SYS] %v | %s \n", t.Format("2006/01/02 - 15:04:05"), s)
+	logAt(context.Background(), slog.LevelInfo, s, slog.Bool("sys", true))
 }
 
 func SysError(s string) {
-	t := time.Now()
-	_, _ = fmt.Fprintf(gin.DefaultErrorWriter, "[SYS] %v | %s \n", t.Format("2006/01/02 - 15:04:05"), s)
+	logAt(context.Background(), slog.LevelError, s, slog.Bool("sys", true))
 }
 
 func Debug(ctx context.Context, msg string) {
-	if config.DebugEnabled {
-		logHelper(ctx, loggerDEBUG, msg)
-	}
+	logAt(ctx, slog.LevelDebug, msg)
 }
 
 func Info(ctx context.Context, msg string) {
-	logHelper(ctx, loggerINFO, msg)
+	logAt(ctx, slog.LevelInfo, msg)
 }
 
 func Warn(ctx context.Context, msg string) {
-	logHelper(ctx, loggerWarn, msg)
+	logAt(ctx, slog.LevelWarn, msg)
 }
 
 func Error(ctx context.Context, msg string) {
-	logHelper(ctx, loggerError, msg)
+	logAt(ctx, slog.LevelError, msg)
 }
 
 func Debugf(ctx context.Context, format string, a ...any) {
-	Debug(ctx, fmt.Sprintf(format, a...))
+	if !defaultLogger.Enabled(ctx, slog.LevelDebug) {
+		return
+	}
+	logAt(ctx, slog.LevelDebug, fmt.Sprintf(format, a...))
 }
 
 func Infof(ctx context.Context, format string, a ...any) {
-	Info(ctx, fmt.Sprintf(format, a...))
+	logAt(ctx, slog.LevelInfo, fmt.Sprintf(format, a...))
 }
 
 func Warnf(ctx context.Context, format string, a ...any) {
-	Warn(ctx, fmt.Sprintf(format, a...))
+	logAt(ctx, slog.LevelWarn, fmt.Sprintf(format, a...))
 }
 
 func Errorf(ctx context.Context, format string, a ...any) {
-	Error(ctx, fmt.Sprintf(format, a...))
+	logAt(ctx, slog.LevelError, fmt.Sprintf(format, a...))
+}
+
+func FatalLog(v ...any) {
+	logAt(context.Background(), slog.LevelError, fmt.Sprint(v...), slog.Bool("fatal", true))
+	os.Exit(1)
 }
 
-func logHelper(ctx context.Context, level string, msg string) {
-	writer := gin.DefaultErrorWriter
-	if level == loggerINFO {
-		writer = gin.DefaultWriter
+// logAt 记录调用方位置,用于按包过滤日志级别
+func logAt(ctx context.Context, level slog.Level, msg string, attrs ...slog.Attr) {
+	if ctx == nil {
+		ctx = context.Background()
 	}
-	id := ctx.Value(helper.RequestIdKey)
-	if id == nil {
-		id = helper.GenRequestID()
+	if !defaultLogger.Enabled(ctx, level) {
+		return
 	}
-	now := time.Now()
-	_, _ = fmt.Fprintf(writer, "[%s] %v | %s | %s \n", level, now.Format("2006/01/02 - 15:04:05"), id, msg)
-	SetupLogger()
+	r := slog.NewRecord(time.Now(), level, msg, callerPC(3))
+	r.AddAttrs(attrs...)
+	_ = defaultLogger.Handler().Handle(ctx, r)
 }
 
-func FatalLog(v ...any) {
-	t := time.Now()
-	_, _ = fmt.Fprintf(gin.DefaultErrorWriter, "[FATAL] %v | %v \n", t.Format("2006/01/02 - 15:04:05"), v)
-	os.Exit(1)
+// requestIdFromContext 兼容 gin.Context 及普通 context 中的请求ID
+func requestIdFromContext(ctx context.Context) string {
+	if id, ok := ctx.Value(helper.RequestIdKey).(string); ok {
+		return id
+	}
+	return ""
 }
@@ -0,0 +1,56 @@
+package logger
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"log/slog"
+	"qodo2api/common/secret"
+	"strings"
+	"testing"
+)
+
+const (
+	testCookie = "AIzaSyLoggerApiKey0123456789abcd=AMf-loggerRefreshToken0123456789"
+	testApiKey = "logger-registered-api-key"
+	testBearer = "unregisteredBearerToken987"
+	testSkKey  = "sk-loggerPatternKey0123456789"
+)
+
+// captureLogs 将日志输出到缓冲区,结束后恢复
+func captureLogs(t *testing.T) *bytes.Buffer {
+	t.Helper()
+	var buf bytes.Buffer
+	previous := defaultLogger
+	defaultLogger = newLogger(&buf, &buf)
+	t.Cleanup(func() { defaultLogger = previous })
+	return &buf
+}
+
+func TestLogRedactsSecrets(t *testing.T) {
+	secret.Register(testCookie, testApiKey)
+	buf := captureLogs(t)
+	ctx := WithAccount(context.Background(), testCookie)
+
+	Infof(ctx, "refresh failed for cookie %s", testCookie)
+	Warnf(ctx, "rejected key %s", testApiKey)
+	Errorf(ctx, "upstream said: Authorization: Bearer %s", testBearer)
+	SysError("client sent " + testSkKey)
+	Logger().Info("attrs",
+		slog.String("cookie", testCookie),
+		slog.Any("err", errors.New("bad key "+testApiKey)),
+		slog.Group("req", slog.String("authorization", "Bearer "+testBearer)))
+	Logger().With(slog.String("api_key", testApiKey)).Info("with attrs")
+
+	out := buf.String()
+	for _, leak := range []string{testCookie, "loggerRefreshToken", testApiKey, testBearer, "loggerPatternKey"} {
+		if strings.Contains(out, leak) {
+			t.Errorf("log output leaks %q:\n%s", leak, out)
+		}
+	}
+	for _, masked := range []string{secret.Mask(testCookie), secret.Mask(testApiKey), "Bearer ***", "sk-***", secret.MaskCookie(testCookie)} {
+		if !strings.Contains(out, masked) {
+			t.Errorf("log output should contain masked form %q:\n%s", masked, out)
+		}
+	}
+}
@@ -0,0 +1,91 @@
+package metrics
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"sync"
+	"sync/atomic"
+)
+
+// metric 以 Prometheus 文本格式输出的指标
+type metric interface {
+	write(w io.Writer)
+}
+
+var (
+	registry      = make(map[string]metric)
+	registryMutex sync.RWMutex
+)
+
+func register(name string, m metric) {
+	registryMutex.Lock()
+	defer registryMutex.Unlock()
+	if _, ok := registry[name]; ok {
+		panic("metrics: duplicate metric " + name)
+	}
+	registry[name] = m
+}
+
+// Counter 单调递增的计数器
+type Counter struct {
+	name  string
+	help  string
+	value atomic.Int64
+}
+
+// NewCounter 创建并登记计数器,name 需全局唯一
+func NewCounter(name string, help string) *Counter {
+	c := &Counter{name: name, help: help}
+	register(name, c)
+	return c
+}
+
+func (c *Counter) Inc() {
+	c.value.Add(1)
+}
+
+func (c *Counter) Add(delta int64) {
+	c.value.Add(delta)
+}
+
+func (c *Counter) Value() int64 {
+	return c.value.Load()
+}
+
+func (c *Counter) write(w io.Writer) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s counter\n%s %d\n", c.name, c.help, c.name, c.name, c.Value())
+}
+
+// gaugeFunc 输出时取值的瞬时指标
+type gaugeFunc struct {
+	name  string
+	help  string
+	value func() float64
+}
+
+// NewGaugeFunc 登记输出时通过 value 取值的瞬时指标
+func NewGaugeFunc(name string, help string, value func() float64) {
+	register(name, &gaugeFunc{name: name, help: help, value: value})
+}
+
+func (g *gaugeFunc) write(w io.Writer) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s gauge\n%s %g\n", g.name, g.help, g.name, g.name, g.value())
+}
+
+// WriteText 按名称顺序以 Prometheus 文本格式输出全部指标
+func WriteText(w io.Writer) {
+	registryMutex.RLock()
+	names := make([]string, 0, len(registry))
+	for name := range registry {
+		names = append(names, name)
+	}
+	registryMutex.RUnlock()
+	sort.Strings(names)
+	for _, name := range names {
+		registryMutex.RLock()
+		m := registry[name]
+		registryMutex.RUnlock()
+		m.write(w)
+	}
+}
@@ -0,0 +1,274 @@
+package proxypool
+
+import (
+	"context"
+	"errors"
+	"hash/fnv"
+	"net/url"
+	"qodo2api/common/secret"
+	"qodo2api/cycletls"
+	"sync"
+	"time"
+)
+
+// Config 代理池配置
+type Config struct {
+	Proxies       []string          // 代理地址,支持 http、https、socks5(h),可携带认证信息
+	Bindings      map[string]string // 账号(cookie)固定使用的代理,值须为 Proxies 中的地址
+	ProbeAddr     string            // 健康检查经代理连接的地址(host:port)
+	ProbeInterval time.Duration     // 健康检查间隔,<=0 时不主动检查
+	ProbeTimeout  time.Duration     // 单次健康检查超时
+	MaxFailures   int               // 连续失败(检查或请求)达到该次数后摘除,由健康检查恢复;<=0 或未开启健康检查时不摘除
+	// OnHealthChange 代理被摘除或恢复时回调,proxy 为脱敏后的地址
+	OnHealthChange func(proxy string, healthy bool, err error)
+}
+
+// Status 单个代理的状态
+type Status struct {
+	Proxy               string    `json:"proxy"` // 脱敏后的地址
+	Healthy             bool      `json:"healthy"`
+	ConsecutiveFailures int       `json:"consecutive_failures"`
+	LastError           string    `json:"last_error,omitempty"`
+	LastCheck           time.Time `json:"last_check,omitempty"`
+	Requests            uint64    `json:"requests"`
+}
+
+type entry struct {
+	url      string
+	label    string
+	healthy  bool
+	failures int
+	lastErr  string
+	lastSeen time.Time
+	requests uint64
+}
+
+var (
+	mutex   sync.Mutex
+	config  Config
+	entries []*entry
+	byUrl   map[string]*entry
+	stop    context.CancelFunc
+	stopped chan struct{}
+)
+
+// Init 按配置初始化代理池并启动健康检查,未配置代理时请求直连
+func Init(c Config) error {
+	pool := make([]*entry, 0, len(c.Proxies))
+	index := make(map[string]*entry, len(c.Proxies))
+	for _, proxy := range c.Proxies {
+		if _, ok := index[proxy]; ok {
+			continue
+		}
+		u, err := url.Parse(proxy)
+		if err != nil || u.Host == "" {
+			return errors.New("invalid proxy url " + label(proxy))
+		}
+		e := &entry{url: proxy, label: u.Redacted(), healthy: true}
+		pool = append(pool, e)
+		index[proxy] = e
+	}
+	for account, proxy := range c.Bindings {
+		if _, ok := index[proxy]; !ok {
+			return errors.New("proxy binding for account " + secret.MaskCookie(account) + " references unknown proxy " + label(proxy))
+		}
+	}
+
+	Close()
+	mutex.Lock()
+	config = c
+	entries = pool
+	byUrl = index
+	mutex.Unlock()
+
+	if len(pool) > 0 && c.ProbeInterval > 0 && c.ProbeAddr != "" {
+		ctx, cancel := context.WithCancel(context.Background())
+		done := make(chan struct{})
+		mutex.Lock()
+		stop, stopped = cancel, done
+		mutex.Unlock()
+		go func() {
+			defer close(done)
+			probeLoop(ctx)
+		}()
+	}
+	return nil
+}
+
+// Close 停止健康检查
+func Close() {
+	mutex.Lock()
+	cancel, done := stop, stopped
+	stop, stopped = nil, nil
+	mutex.Unlock()
+	if cancel != nil {
+		cancel()
+		<-done
+	}
+}
+
+// Get 返回账号(cookie)本次请求使用的代理,未配置代理时返回空字符串。
+// 绑定的代理健康时优先使用;否则按账号在健康代理中做一致性哈希,
+// 同一账号的出口IP保持稳定,账号均匀分布在各代理上,代理摘除或恢复时只影响其上的账号
+func Get(account string) string {
+	mutex.Lock()
+	defer mutex.Unlock()
+	if len(entries) == 0 {
+		return ""
+	}
+	if proxy, ok := config.Bindings[account]; ok {
+		if e := byUrl[proxy]; e.healthy {
+			e.requests++
+			return e.url
+		}
+	}
+	candidates := make([]*entry, 0, len(entries))
+	for _, e := range entries {
+		if e.healthy {
+			candidates = append(candidates, e)
+		}
+	}
+	if len(candidates) == 0 {
+		// 全部被摘除时仍按原分布使用,避免所有请求直接失败
+		candidates = entries
+	}
+	var best *entry
+	var bestScore uint64
+	for _, e := range candidates {
+		h := fnv.New64a()
+		h.Write([]byte(account))
+		h.Write([]byte{0})
+		h.Write([]byte(e.url))
+		if score := h.Sum64(); best == nil || score > bestScore {
+			best, bestScore = e, score
+		}
+	}
+	best.requests++
+	return best.url
+}
+
+// ReportSuccess 经代理的请求成功
+func ReportSuccess(proxy string) {
+	report(proxy, nil)
+}
+
+// ReportFailure 经代理的请求未能连接上游
+func ReportFailure(proxy string, err error) {
+	if err == nil {
+		err = errors.New("request failed")
+	}
+	report(proxy, err)
+}
+
+// Stats 各代理的状态
+func Stats() []Status {
+	mutex.Lock()
+	defer mutex.Unlock()
+	result := make([]Status, 0, len(entries))
+	for _, e := range entries {
+		result = append(result, Status{
+			Proxy:               e.label,
+			Healthy:             e.healthy,
+			ConsecutiveFailures: e.failures,
+			LastError:           e.lastErr,
+			LastCheck:           e.lastSeen,
+			Requests:            e.requests,
+		})
+	}
+	return result
+}
+
+// HealthyCount 未被摘除的代理数量及代理总数
+func HealthyCount() (healthy int, total int) {
+	mutex.Lock()
+	defer mutex.Unlock()
+	for _, e := range entries {
+		if e.healthy {
+			healthy++
+		}
+	}
+	return healthy, len(entries)
+}
+
+func report(proxy string, err error) {
+	mutex.Lock()
+	e, ok := byUrl[proxy]
+	if !ok {
+		mutex.Unlock()
+		return
+	}
+	e.lastSeen = time.Now()
+	wasHealthy := e.healthy
+	if err == nil {
+		e.failures = 0
+		e.lastErr = ""
+		e.healthy = true
+	} else {
+		e.failures++
+		e.lastErr = err.Error()
+		if config.MaxFailures > 0 && e.failures >= config.MaxFailures && stop != nil {
+			e.healthy = false
+		}
+	}
+	changed := wasHealthy != e.healthy
+	callback, name := config.OnHealthChange, e.label
+	mutex.Unlock()
+
+	if changed && callback != nil {
+		callback(name, !wasHealthy, err)
+	}
+}
+
+func probeLoop(ctx context.Context) {
+	mutex.Lock()
+	interval := config.ProbeInterval
+	mutex.Unlock()
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		probeAll(ctx)
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// probeAll 并发检查全部代理
+func probeAll(ctx context.Context) {
+	mutex.Lock()
+	proxies := make([]string, 0, len(entries))
+	for _, e := range entries {
+		proxies = append(proxies, e.url)
+	}
+	addr, timeout := config.ProbeAddr, config.ProbeTimeout
+	mutex.Unlock()
+	if timeout <= 0 {
+		timeout = 10 * time.Second
+	}
+
+	var wg sync.WaitGroup
+	for _, proxy := range proxies {
+		wg.Add(1)
+		go func(proxy string) {
+			defer wg.Done()
+			probeCtx, cancel := context.WithTimeout(ctx, timeout)
+			defer cancel()
+			err := cycletls.ProbeProxy(probeCtx, proxy, addr)
+			if ctx.Err() != nil {
+				return
+			}
+			report(proxy, err)
+		}(proxy)
+	}
+	wg.Wait()
+}
+
+// label 返回隐藏密码后的代理地址
+func label(proxy string) string {
+	if u, err := url.Parse(proxy); err == nil {
+		return u.Redacted()
+	}
+	return "(unparseable)"
+}
@@ -0,0 +1,282 @@
+package proxypool
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+// startConnectProxy 启动只支持 CONNECT 的HTTP代理,健康检查经其连接目标地址
+func startConnectProxy(t *testing.T) string {
+	t.Helper()
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodConnect {
+			http.Error(w, "CONNECT only", http.StatusMethodNotAllowed)
+			return
+		}
+		upstream, err := net.Dial("tcp", r.Host)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadGateway)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+		conn, _, err := w.(http.Hijacker).Hijack()
+		if err != nil {
+			upstream.Close()
+			return
+		}
+		go func() {
+			defer conn.Close()
+			defer upstream.Close()
+			go io.Copy(upstream, conn)
+			io.Copy(conn, upstream)
+		}()
+	}))
+	t.Cleanup(server.Close)
+	return server.URL
+}
+
+// startProbeTarget 健康检查连接的目标地址
+func startProbeTarget(t *testing.T) string {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			conn.Close()
+		}
+	}()
+	return listener.Addr().String()
+}
+
+func initPool(t *testing.T, c Config) {
+	t.Helper()
+	if err := Init(c); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		_ = Init(Config{})
+	})
+}
+
+// waitProbed 等待启动时的首轮健康检查完成
+func waitProbed(t *testing.T) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		probed := true
+		for _, status := range Stats() {
+			probed = probed && !status.LastCheck.IsZero()
+		}
+		if probed {
+			return
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	t.Fatal("initial probe did not finish")
+}
+
+func healthy(proxy string) bool {
+	mutex.Lock()
+	defer mutex.Unlock()
+	return byUrl[proxy].healthy
+}
+
+func setHealthy(proxy string, value bool) {
+	mutex.Lock()
+	defer mutex.Unlock()
+	byUrl[proxy].healthy = value
+}
+
+var testProxies = []string{"http://127.0.0.1:3001", "http://127.0.0.1:3002", "http://127.0.0.1:3003"}
+
+func TestGetWithoutProxies(t *testing.T) {
+	initPool(t, Config{})
+	if got := Get("account"); got != "" {
+		t.Errorf("Get = %q, want direct connection", got)
+	}
+}
+
+func TestGetBinding(t *testing.T) {
+	initPool(t, Config{Proxies: testProxies})
+	// 找到哈希选中的代理以外的一个,确认绑定优先于哈希
+	hashed := Get("bound")
+	var bound string
+	for _, proxy := range testProxies {
+		if proxy != hashed {
+			bound = proxy
+			break
+		}
+	}
+	initPool(t, Config{Proxies: testProxies, Bindings: map[string]string{"bound": bound}})
+	if got := Get("bound"); got != bound {
+		t.Errorf("Get = %q, want bound proxy %q", got, bound)
+	}
+
+	// 绑定的代理被摘除时按哈希回退到其他健康代理
+	setHealthy(bound, false)
+	if got := Get("bound"); got != hashed {
+		t.Errorf("Get with unhealthy binding = %q, want %q", got, hashed)
+	}
+}
+
+func TestInitRejectsUnknownBinding(t *testing.T) {
+	err := Init(Config{Proxies: testProxies, Bindings: map[string]string{"a": "http://127.0.0.1:9999"}})
+	if err == nil {
+		t.Fatal("binding to an unknown proxy should fail")
+	}
+}
+
+func TestGetRendezvousHashing(t *testing.T) {
+	initPool(t, Config{Proxies: testProxies})
+	assigned := make(map[string]string)
+	counts := make(map[string]int)
+	for i := 0; i < 300; i++ {
+		account := fmt.Sprintf("account-%d", i)
+		assigned[account] = Get(account)
+		counts[assigned[account]]++
+	}
+	for _, proxy := range testProxies {
+		if counts[proxy] == 0 {
+			t.Errorf("no account assigned to %s: %v", proxy, counts)
+		}
+	}
+	// 同一账号多次获取结果不变
+	for account, proxy := range assigned {
+		if got := Get(account); got != proxy {
+			t.Fatalf("Get(%s) = %q, want stable %q", account, got, proxy)
+		}
+	}
+
+	// 摘除一个代理只影响其上的账号
+	removed := testProxies[0]
+	setHealthy(removed, false)
+	for account, proxy := range assigned {
+		got := Get(account)
+		if proxy != removed && got != proxy {
+			t.Errorf("Get(%s) moved from %q to %q", account, proxy, got)
+		}
+		if got == removed {
+			t.Errorf("Get(%s) returned removed proxy", account)
+		}
+	}
+
+	// 全部被摘除时仍按原分布使用
+	for _, proxy := range testProxies {
+		setHealthy(proxy, false)
+	}
+	for account, proxy := range assigned {
+		if got := Get(account); got != proxy {
+			t.Fatalf("Get(%s) with all proxies removed = %q, want %q", account, got, proxy)
+		}
+	}
+}
+
+func TestReportWithoutProbing(t *testing.T) {
+	initPool(t, Config{Proxies: testProxies[:1], MaxFailures: 2})
+	for i := 0; i < 5; i++ {
+		ReportFailure(testProxies[0], errors.New("dial failed"))
+	}
+	// 未开启健康检查时无法恢复,不摘除
+	if !healthy(testProxies[0]) {
+		t.Error("proxy removed without probing")
+	}
+	if status := Stats()[0]; status.ConsecutiveFailures != 5 || status.LastError != "dial failed" {
+		t.Errorf("status = %+v", status)
+	}
+}
+
+type healthChange struct {
+	proxy   string
+	healthy bool
+	err     error
+}
+
+func TestReportRemovesAndProbeRecovers(t *testing.T) {
+	proxy := startConnectProxy(t)
+	var mu sync.Mutex
+	var changes []healthChange
+	initPool(t, Config{
+		Proxies:       []string{proxy},
+		ProbeAddr:     startProbeTarget(t),
+		ProbeInterval: time.Hour,
+		ProbeTimeout:  5 * time.Second,
+		MaxFailures:   3,
+		OnHealthChange: func(proxy string, healthy bool, err error) {
+			mu.Lock()
+			defer mu.Unlock()
+			changes = append(changes, healthChange{proxy, healthy, err})
+		},
+	})
+	waitProbed(t)
+	if status := Stats()[0]; !status.Healthy || status.LastError != "" {
+		t.Fatalf("status after probe = %+v", status)
+	}
+
+	failure := errors.New("dial failed")
+	ReportFailure(proxy, failure)
+	ReportFailure(proxy, failure)
+	if !healthy(proxy) {
+		t.Fatal("proxy removed before MaxFailures")
+	}
+	ReportFailure(proxy, failure)
+	if healthy(proxy) {
+		t.Fatal("proxy not removed at MaxFailures")
+	}
+	if h, total := HealthyCount(); h != 0 || total != 1 {
+		t.Errorf("HealthyCount = %d/%d", h, total)
+	}
+
+	// 健康检查成功后恢复
+	probeAll(context.Background())
+	if !healthy(proxy) {
+		t.Fatal("proxy not recovered by probe")
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	want := []healthChange{{proxy, false, failure}, {proxy, true, nil}}
+	if len(changes) != len(want) {
+		t.Fatalf("changes = %+v, want %+v", changes, want)
+	}
+	for i := range want {
+		if changes[i] != want[i] {
+			t.Errorf("change %d = %+v, want %+v", i, changes[i], want[i])
+		}
+	}
+}
+
+func TestProbeRemovesUnreachableProxy(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	dead := "http://" + listener.Addr().String()
+	listener.Close()
+
+	initPool(t, Config{
+		Proxies:       []string{dead},
+		ProbeAddr:     startProbeTarget(t),
+		ProbeInterval: time.Hour,
+		ProbeTimeout:  time.Second,
+		MaxFailures:   1,
+	})
+	waitProbed(t)
+	if status := Stats()[0]; status.Healthy || status.LastError == "" {
+		t.Errorf("status = %+v, want removed with error", status)
+	}
+}
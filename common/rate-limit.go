@@ -1,70 +1,32 @@
 package common
 
 import (
-	"sync"
-	"time"
+	"context"
+	"qodo2api/common/state"
 )
 
-type InMemoryRateLimiter struct {
-	store              map[string]*[]int64
-	mutex              sync.Mutex
-	expirationDuration time.Duration
-}
+// TokenBucketLimiter 按key划分的令牌桶限流器,令牌按每分钟速率匀速补充,桶容量即允许的突发量。
+// 桶状态保存在 state 后端中,多实例部署时共享计数
+type TokenBucketLimiter struct{}
 
-func (l *InMemoryRateLimiter) Init(expirationDuration time.Duration) {
-	if l.store == nil {
-		l.mutex.Lock()
-		if l.store == nil {
-			l.store = make(map[string]*[]int64)
-			l.expirationDuration = expirationDuration
-			if expirationDuration > 0 {
-				go l.clearExpiredItems()
-			}
-		}
-		l.mutex.Unlock()
-	}
+// TokenBucketResult 单次取令牌的结果,用于生成 x-ratelimit-* 响应头
+type TokenBucketResult = state.BucketResult
+
+// Take 从key对应的桶中取出n个令牌,令牌不足时不扣减并返回 Allowed=false
+func (l *TokenBucketLimiter) Take(key string, n int, ratePerMinute int, burst int) TokenBucketResult {
+	return l.take(key, n, ratePerMinute, burst, false)
 }
 
-func (l *InMemoryRateLimiter) clearExpiredItems() {
-	for {
-		time.Sleep(l.expirationDuration)
-		l.mutex.Lock()
-		now := time.Now().Unix()
-		for key := range l.store {
-			queue := l.store[key]
-			size := len(*queue)
-			if size == 0 || now-(*queue)[size-1] > int64(l.expirationDuration.Seconds()) {
-				delete(l.store, key)
-			}
-		}
-		l.mutex.Unlock()
-	}
+// Consume 从key对应的桶中强制扣减n个令牌,允许余额为负,用于事后结算(如补扣生成的token数)
+func (l *TokenBucketLimiter) Consume(key string, n int, ratePerMinute int, burst int) TokenBucketResult {
+	return l.take(key, n, ratePerMinute, burst, true)
 }
 
-// Request parameter duration's unit is seconds
-func (l *InMemoryRateLimiter) Request(key string, maxRequestNum int, duration int64) bool {
-	l.mutex.Lock()
-	defer l.mutex.Unlock()
-	// [old <-- new]
-	queue, ok := l.store[key]
-	now := time.Now().Unix()
-	if ok {
-		if len(*queue) < maxRequestNum {
-			*queue = append(*queue, now)
-			return true
-		} else {
-			if now-(*queue)[0] >= duration {
-				*queue = (*queue)[1:]
-				*queue = append(*queue, now)
-				return true
-			} else {
-				return false
-			}
-		}
-	} else {
-		s := make([]int64, 0, maxRequestNum)
-		l.store[key] = &s
-		*(l.store[key]) = append(*(l.store[key]), now)
+func (l *TokenBucketLimiter) take(key string, n int, ratePerMinute int, burst int, force bool) TokenBucketResult {
+	result, err := state.Default().TakeBucket(context.Background(), key, n, ratePerMinute, burst, force)
+	if err != nil {
+		// 状态后端不可用时放行,避免限流组件故障导致服务整体不可用
+		return TokenBucketResult{Allowed: true, Limit: ratePerMinute}
 	}
-	return true
+	return result
 }
@@ -0,0 +1,87 @@
+package retry
+
+import (
+	"context"
+	"math/rand"
+	"sync"
+	"time"
+)
+
+// maxBackoff 单次等待时间的硬上限,避免重试次数很大时翻倍溢出
+const maxBackoff = time.Hour
+
+// Policy 瞬时失败的重试策略
+type Policy struct {
+	MaxAttempts int           // 最多尝试次数(含首次),<=1 时不重试
+	BaseDelay   time.Duration // 首次重试前的等待时间,之后每次翻倍
+	MaxDelay    time.Duration // 单次等待时间上限,<=0 或超过 maxBackoff 时按 maxBackoff
+	Deadline    time.Duration // 自首次尝试起的总时长上限,等待后将超出时不再重试,<=0 时不限制
+}
+
+// Budget 单个请求的重试额度,各次重试(包括降级到其他模型后的重试)共用
+type Budget struct {
+	mutex    sync.Mutex
+	policy   Policy
+	started  time.Time
+	attempts int
+}
+
+// Start 开始计量一个请求的重试额度,首次尝试计入次数
+func (p Policy) Start() *Budget {
+	return &Budget{policy: p, started: time.Now(), attempts: 1}
+}
+
+// Attempts 已尝试的次数
+func (b *Budget) Attempts() int {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	return b.attempts
+}
+
+// Wait 额度允许时按退避时间等待后返回true,次数或总时长用尽、ctx结束时返回false
+func (b *Budget) Wait(ctx context.Context) bool {
+	b.mutex.Lock()
+	if b.attempts >= b.policy.MaxAttempts {
+		b.mutex.Unlock()
+		return false
+	}
+	delay := Backoff(b.attempts, b.policy.BaseDelay, b.policy.MaxDelay)
+	if b.policy.Deadline > 0 && time.Since(b.started)+delay >= b.policy.Deadline {
+		b.mutex.Unlock()
+		return false
+	}
+	b.attempts++
+	b.mutex.Unlock()
+
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return false
+	case <-timer.C:
+		return true
+	}
+}
+
+// Backoff 第 retry 次重试(从1开始)前的等待时间: base*2^(retry-1),不超过 max(<=0 时为 maxBackoff),
+// 并在 [d/2, d) 内随机抖动以错开并发重试
+func Backoff(retry int, base, max time.Duration) time.Duration {
+	if base <= 0 || retry < 1 {
+		return 0
+	}
+	if max <= 0 || max > maxBackoff {
+		max = maxBackoff
+	}
+	d := base
+	for i := 1; i < retry && d < max; i++ {
+		d *= 2
+	}
+	if d > max {
+		d = max
+	}
+	half := d / 2
+	if half <= 0 {
+		return d
+	}
+	return half + time.Duration(rand.Int63n(int64(half)))
+}
@@ -0,0 +1,85 @@
+package retry
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestBackoff(t *testing.T) {
+	tests := []struct {
+		name  string
+		retry int
+		base  time.Duration
+		max   time.Duration
+		want  time.Duration // 抖动前的等待时间,结果应在 [want/2, want) 内
+	}{
+		{name: "first retry", retry: 1, base: 100 * time.Millisecond, max: time.Second, want: 100 * time.Millisecond},
+		{name: "doubling", retry: 3, base: 100 * time.Millisecond, max: time.Second, want: 400 * time.Millisecond},
+		{name: "capped by max", retry: 5, base: 100 * time.Millisecond, max: time.Second, want: time.Second},
+		{name: "base over max", retry: 1, base: 2 * time.Second, max: time.Second, want: time.Second},
+		{name: "unlimited max", retry: 4, base: 100 * time.Millisecond, want: 800 * time.Millisecond},
+		{name: "many retries do not overflow", retry: 200, base: 100 * time.Millisecond, want: maxBackoff},
+		{name: "max over ceiling", retry: 200, base: time.Second, max: 1 << 62, want: maxBackoff},
+		{name: "no base", retry: 3, max: time.Second, want: 0},
+		{name: "no retry", retry: 0, base: time.Second, max: time.Second, want: 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			for i := 0; i < 100; i++ {
+				got := Backoff(tt.retry, tt.base, tt.max)
+				if tt.want == 0 {
+					if got != 0 {
+						t.Fatalf("Backoff = %v, want 0", got)
+					}
+					continue
+				}
+				if got < tt.want/2 || got >= tt.want {
+					t.Fatalf("Backoff = %v, want in [%v, %v)", got, tt.want/2, tt.want)
+				}
+			}
+		})
+	}
+}
+
+func TestBudgetWait(t *testing.T) {
+	tests := []struct {
+		name   string
+		policy Policy
+		min    int // 用尽前允许的重试次数范围
+		max    int
+	}{
+		{name: "no retry", policy: Policy{MaxAttempts: 1, BaseDelay: time.Millisecond}},
+		{name: "attempt limit", policy: Policy{MaxAttempts: 3, BaseDelay: time.Millisecond, MaxDelay: 2 * time.Millisecond}, min: 2, max: 2},
+		// 抖动后每次等待 10~20ms,50ms 内只能重试 2~4 次
+		{name: "deadline", policy: Policy{MaxAttempts: 10, BaseDelay: 20 * time.Millisecond, MaxDelay: 20 * time.Millisecond, Deadline: 50 * time.Millisecond}, min: 2, max: 4},
+		{name: "deadline shorter than first delay", policy: Policy{MaxAttempts: 10, BaseDelay: 400 * time.Millisecond, Deadline: 100 * time.Millisecond}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			budget := tt.policy.Start()
+			retries := 0
+			for budget.Wait(context.Background()) {
+				retries++
+				if retries > tt.policy.MaxAttempts {
+					t.Fatal("Wait did not stop at MaxAttempts")
+				}
+			}
+			if retries < tt.min || retries > tt.max {
+				t.Errorf("retries = %d, want %d..%d", retries, tt.min, tt.max)
+			}
+			if got := budget.Attempts(); got != retries+1 {
+				t.Errorf("Attempts = %d, want %d", got, retries+1)
+			}
+		})
+	}
+}
+
+func TestBudgetWaitContextDone(t *testing.T) {
+	budget := Policy{MaxAttempts: 3, BaseDelay: time.Minute}.Start()
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if budget.Wait(ctx) {
+		t.Error("Wait should return false once ctx is done")
+	}
+}
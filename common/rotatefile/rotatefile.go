@@ -0,0 +1,253 @@
+package rotatefile
+
+import (
+	"compress/gzip"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const dayFormat = "20060102"
+
+const compressSuffix = ".gz"
+
+// Options 滚动及清理配置,数值为0时不限制
+type Options struct {
+	MaxSize    int64         // 单个文件的最大字节数
+	MaxBackups int           // 保留的历史文件数
+	MaxAge     time.Duration // 历史文件保留时长
+	Daily      bool          // 跨天(本地时间零点)时滚动
+	Compress   bool          // 滚动后以gzip压缩历史文件
+}
+
+// Writer 按大小及日期滚动的文件写入器,滚动后的文件以内容所属日期及序号命名(如 app.20250601.1.log),并按数量及保留天数清理
+type Writer struct {
+	filename string
+	options  Options
+	backupRe *regexp.Regexp // 匹配本写入器生成的历史文件名
+
+	mu      sync.Mutex
+	file    *os.File
+	size    int64
+	openDay string
+
+	millMu sync.Mutex
+}
+
+// New 创建写入器
+func New(filename string, options Options) (*Writer, error) {
+	ext := filepath.Ext(filename)
+	w := &Writer{
+		filename: filename,
+		options:  options,
+		backupRe: regexp.MustCompile(`^` + regexp.QuoteMeta(strings.TrimSuffix(filepath.Base(filename), ext)) +
+			`\.\d{8}\.\d+` + regexp.QuoteMeta(ext) + `(` + regexp.QuoteMeta(compressSuffix) + `)?$`),
+	}
+	if err := os.MkdirAll(filepath.Dir(filename), 0755); err != nil {
+		return nil, err
+	}
+	if err := w.open(); err != nil {
+		return nil, err
+	}
+	return w, nil
+}
+
+func (w *Writer) open() error {
+	file, err := os.OpenFile(w.filename, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		_ = file.Close()
+		return err
+	}
+	w.file = file
+	w.size = info.Size()
+	// 以文件最后修改时间所在日期为准,重启后跨天的旧文件会在首次写入时滚动
+	w.openDay = info.ModTime().Format(dayFormat)
+	if w.size == 0 {
+		w.openDay = time.Now().Format(dayFormat)
+	}
+	return nil
+}
+
+func (w *Writer) Write(p []byte) (int, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if w.file == nil {
+		return 0, os.ErrClosed
+	}
+	if w.shouldRotate(len(p)) {
+		if err := w.rotate(); err != nil {
+			return 0, err
+		}
+	}
+	n, err := w.file.Write(p)
+	w.size += int64(n)
+	return n, err
+}
+
+func (w *Writer) shouldRotate(n int) bool {
+	if w.size == 0 {
+		return false
+	}
+	if w.options.MaxSize > 0 && w.size+int64(n) > w.options.MaxSize {
+		return true
+	}
+	return w.options.Daily && time.Now().Format(dayFormat) != w.openDay
+}
+
+// Rotate 立即滚动当前文件
+func (w *Writer) Rotate() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.rotate()
+}
+
+func (w *Writer) rotate() error {
+	if w.file != nil {
+		if err := w.file.Close(); err != nil {
+			return err
+		}
+		w.file = nil
+	}
+	// 以内容所属日期命名,跨天滚动时为前一天
+	backup := w.backupName(w.openDay)
+	if err := os.Rename(w.filename, backup); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if err := w.open(); err != nil {
+		return err
+	}
+	go w.mill(backup)
+	return nil
+}
+
+// mill 压缩刚滚动的历史文件并清理过期文件,串行执行避免并发滚动时互相干扰
+func (w *Writer) mill(backup string) {
+	w.millMu.Lock()
+	defer w.millMu.Unlock()
+	if w.options.Compress {
+		if err := compressFile(backup); err != nil {
+			_, _ = fmt.Fprintf(os.Stderr, "rotatefile: compress %s failed: %v\n", backup, err)
+		}
+	}
+	w.cleanup()
+}
+
+func compressFile(path string) error {
+	src, err := os.Open(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	defer src.Close()
+
+	dst, err := os.OpenFile(path+compressSuffix, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	gz := gzip.NewWriter(dst)
+	if _, err = io.Copy(gz, src); err == nil {
+		err = gz.Close()
+	}
+	if closeErr := dst.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		_ = os.Remove(path + compressSuffix)
+		return err
+	}
+	_ = src.Close()
+	return os.Remove(path)
+}
+
+// backupName 返回 <文件名>.<日期>.<序号><扩展名>,序号取该日期下第一个未被占用(含已压缩)的值
+func (w *Writer) backupName(day string) string {
+	ext := filepath.Ext(w.filename)
+	prefix := strings.TrimSuffix(w.filename, ext)
+	for seq := 1; ; seq++ {
+		name := fmt.Sprintf("%s.%s.%d%s", prefix, day, seq, ext)
+		if !exists(name) && !exists(name+compressSuffix) {
+			return name
+		}
+	}
+}
+
+func exists(path string) bool {
+	_, err := os.Stat(path)
+	return err == nil
+}
+
+// cleanup 删除超出保留数量或保留时长的历史文件,只处理按本写入器命名规则生成的文件
+func (w *Writer) cleanup() {
+	maxBackups, maxAge := w.options.MaxBackups, w.options.MaxAge
+	if maxBackups <= 0 && maxAge <= 0 {
+		return
+	}
+	ext := filepath.Ext(w.filename)
+	candidates, err := filepath.Glob(strings.TrimSuffix(w.filename, ext) + ".*")
+	if err != nil {
+		return
+	}
+	var matches []string
+	for _, path := range candidates {
+		if w.backupRe.MatchString(filepath.Base(path)) {
+			matches = append(matches, path)
+		}
+	}
+
+	type backup struct {
+		path    string
+		modTime time.Time
+	}
+	var backups []backup
+	for _, path := range matches {
+		info, err := os.Stat(path)
+		if err != nil {
+			continue
+		}
+		backups = append(backups, backup{path: path, modTime: info.ModTime()})
+	}
+	sort.Slice(backups, func(i, j int) bool {
+		return backups[i].modTime.After(backups[j].modTime)
+	})
+
+	cutoff := time.Now().Add(-maxAge)
+	for i, b := range backups {
+		if (maxBackups > 0 && i >= maxBackups) || (maxAge > 0 && b.modTime.Before(cutoff)) {
+			_ = os.Remove(b.path)
+		}
+	}
+}
+
+// Sync 将缓冲数据刷新到磁盘
+func (w *Writer) Sync() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.file == nil {
+		return nil
+	}
+	return w.file.Sync()
+}
+
+func (w *Writer) Close() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.file == nil {
+		return nil
+	}
+	err := w.file.Close()
+	w.file = nil
+	return err
+}
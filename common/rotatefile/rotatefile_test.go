@@ -0,0 +1,154 @@
+package rotatefile
+
+import (
+	"os"
+	"path/filepath"
+	"slices"
+	"sort"
+	"testing"
+	"time"
+)
+
+// listDir 返回目录中的文件名
+func listDir(t *testing.T, dir string) []string {
+	t.Helper()
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, entry := range entries {
+		names = append(names, entry.Name())
+	}
+	sort.Strings(names)
+	return names
+}
+
+// waitFor 等待后台的压缩及清理完成
+func waitFor(t *testing.T, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(2 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatal("condition not met in time")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func write(t *testing.T, w *Writer, s string) {
+	t.Helper()
+	if _, err := w.Write([]byte(s)); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestSizeRotationNamesBackupsByContentDay(t *testing.T) {
+	dir := t.TempDir()
+	w, err := New(filepath.Join(dir, "app.log"), Options{MaxSize: 10})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+
+	write(t, w, "0123456789")
+	write(t, w, "abcdefghij")
+	write(t, w, "ABCDEFGHIJ")
+
+	today := time.Now().Format(dayFormat)
+	want := []string{"app." + today + ".1.log", "app." + today + ".2.log", "app.log"}
+	if got := listDir(t, dir); !slices.Equal(got, want) {
+		t.Fatalf("files = %v, want %v", got, want)
+	}
+	for name, content := range map[string]string{want[0]: "0123456789", want[1]: "abcdefghij", want[2]: "ABCDEFGHIJ"} {
+		data, _ := os.ReadFile(filepath.Join(dir, name))
+		if string(data) != content {
+			t.Errorf("%s = %q, want %q", name, data, content)
+		}
+	}
+}
+
+// 跨天滚动的历史文件以其内容所属的前一天命名,而不是滚动发生的时间
+func TestDailyRotationUsesPreviousDay(t *testing.T) {
+	dir := t.TempDir()
+	filename := filepath.Join(dir, "app.log")
+	if err := os.WriteFile(filename, []byte("yesterday\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	yesterday := time.Now().AddDate(0, 0, -1)
+	if err := os.Chtimes(filename, yesterday, yesterday); err != nil {
+		t.Fatal(err)
+	}
+
+	w, err := New(filename, Options{Daily: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+	write(t, w, "today\n")
+
+	backup := filepath.Join(dir, "app."+yesterday.Format(dayFormat)+".1.log")
+	data, err := os.ReadFile(backup)
+	if err != nil || string(data) != "yesterday\n" {
+		t.Fatalf("backup %s = %q, %v", backup, data, err)
+	}
+	data, _ = os.ReadFile(filename)
+	if string(data) != "today\n" {
+		t.Errorf("current file = %q", data)
+	}
+}
+
+// 清理只删除本写入器命名的历史文件,旧版本按日命名的日志(qodo2api-YYYYMMDD.log)等同前缀文件保持不变
+func TestCleanupOnlyRemovesOwnBackups(t *testing.T) {
+	dir := t.TempDir()
+	old := time.Now().Add(-30 * 24 * time.Hour)
+	foreign := []string{"qodo2api-20240101.log", "qodo2api-20240102.log", "qodo2api.notes.log", "qodo2api.20240101.log"}
+	for _, name := range foreign {
+		path := filepath.Join(dir, name)
+		if err := os.WriteFile(path, []byte("keep"), 0644); err != nil {
+			t.Fatal(err)
+		}
+		_ = os.Chtimes(path, old, old)
+	}
+	expired := filepath.Join(dir, "qodo2api.20240101.1.log.gz")
+	if err := os.WriteFile(expired, []byte("old backup"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	_ = os.Chtimes(expired, old, old)
+
+	w, err := New(filepath.Join(dir, "qodo2api.log"), Options{MaxSize: 5, MaxBackups: 1, MaxAge: 7 * 24 * time.Hour})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+	for i := 0; i < 3; i++ {
+		write(t, w, "12345")
+		time.Sleep(20 * time.Millisecond)
+	}
+
+	today := time.Now().Format(dayFormat)
+	want := append([]string{"qodo2api." + today + ".2.log", "qodo2api.log"}, foreign...)
+	sort.Strings(want)
+	waitFor(t, func() bool { return slices.Equal(listDir(t, dir), want) })
+}
+
+func TestCompress(t *testing.T) {
+	dir := t.TempDir()
+	w, err := New(filepath.Join(dir, "audit.jsonl"), Options{Compress: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+	write(t, w, "{}\n")
+	if err := w.Rotate(); err != nil {
+		t.Fatal(err)
+	}
+	write(t, w, "{}\n")
+	if err := w.Rotate(); err != nil {
+		t.Fatal(err)
+	}
+
+	today := time.Now().Format(dayFormat)
+	want := []string{"audit." + today + ".1.jsonl.gz", "audit." + today + ".2.jsonl.gz", "audit.jsonl"}
+	waitFor(t, func() bool { return slices.Equal(listDir(t, dir), want) })
+}
@@ -0,0 +1,178 @@
+package state
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// MemoryBackend 进程内存状态后端,仅适用于单实例部署
+type MemoryBackend struct {
+	mutex    sync.Mutex
+	locks    map[string]time.Time
+	removed  map[string]time.Time
+	tokens   map[string]Token
+	buckets  map[string]*memoryBucket
+	counters map[string]*memoryCounter
+}
+
+type memoryBucket struct {
+	tokens   float64
+	lastTime time.Time
+}
+
+type memoryCounter struct {
+	value    int64
+	expireAt time.Time
+}
+
+func NewMemoryBackend() *MemoryBackend {
+	b := &MemoryBackend{
+		locks:    make(map[string]time.Time),
+		removed:  make(map[string]time.Time),
+		tokens:   make(map[string]Token),
+		buckets:  make(map[string]*memoryBucket),
+		counters: make(map[string]*memoryCounter),
+	}
+	go b.clearExpiredItems()
+	return b
+}
+
+func (b *MemoryBackend) clearExpiredItems() {
+	for {
+		time.Sleep(bucketExpiration)
+		b.mutex.Lock()
+		now := time.Now()
+		for key, bucket := range b.buckets {
+			if now.Sub(bucket.lastTime) > bucketExpiration {
+				delete(b.buckets, key)
+			}
+		}
+		for key, counter := range b.counters {
+			if now.After(counter.expireAt) {
+				delete(b.counters, key)
+			}
+		}
+		for account, until := range b.locks {
+			if now.After(until) {
+				delete(b.locks, account)
+			}
+		}
+		for account, until := range b.removed {
+			if now.After(until) {
+				delete(b.removed, account)
+			}
+		}
+		b.mutex.Unlock()
+	}
+}
+
+func (b *MemoryBackend) LockAccount(_ context.Context, account string, until time.Time) error {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	b.locks[account] = until
+	return nil
+}
+
+func (b *MemoryBackend) GetAccountLock(_ context.Context, account string) (time.Time, bool, error) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	until, ok := b.locks[account]
+	if !ok {
+		return time.Time{}, false, nil
+	}
+	if !until.After(time.Now()) {
+		delete(b.locks, account)
+		return time.Time{}, false, nil
+	}
+	return until, true, nil
+}
+
+func (b *MemoryBackend) RemoveAccount(_ context.Context, account string, until time.Time) error {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	if !until.After(time.Now()) {
+		delete(b.removed, account)
+		return nil
+	}
+	b.removed[account] = until
+	return nil
+}
+
+func (b *MemoryBackend) IsAccountRemoved(_ context.Context, account string) (bool, error) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	until, ok := b.removed[account]
+	if !ok {
+		return false, nil
+	}
+	if !until.After(time.Now()) {
+		delete(b.removed, account)
+		return false, nil
+	}
+	return true, nil
+}
+
+func (b *MemoryBackend) SetToken(_ context.Context, account string, token Token) error {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	b.tokens[account] = token
+	return nil
+}
+
+func (b *MemoryBackend) GetToken(_ context.Context, account string) (Token, bool, error) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	token, ok := b.tokens[account]
+	return token, ok, nil
+}
+
+func (b *MemoryBackend) TakeBucket(_ context.Context, key string, n int, ratePerMinute int, burst int, force bool) (BucketResult, error) {
+	if burst <= 0 {
+		burst = ratePerMinute
+	}
+
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	now := time.Now()
+	bucket, ok := b.buckets[key]
+	if !ok {
+		bucket = &memoryBucket{tokens: float64(burst), lastTime: now}
+		b.buckets[key] = bucket
+	}
+	tokens, allowed := refillBucket(bucket.tokens, now.Sub(bucket.lastTime), n, ratePerMinute, burst, force)
+	bucket.tokens = tokens
+	bucket.lastTime = now
+	return newBucketResult(tokens, n, ratePerMinute, burst, allowed), nil
+}
+
+func (b *MemoryBackend) IncrCounter(_ context.Context, key string, delta int64, ttl time.Duration) (int64, error) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	now := time.Now()
+	counter, ok := b.counters[key]
+	if !ok || now.After(counter.expireAt) {
+		counter = &memoryCounter{}
+		b.counters[key] = counter
+	}
+	counter.value += delta
+	counter.expireAt = now.Add(ttl)
+	return counter.value, nil
+}
+
+func (b *MemoryBackend) GetCounter(_ context.Context, key string) (int64, error) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	counter, ok := b.counters[key]
+	if !ok || time.Now().After(counter.expireAt) {
+		return 0, nil
+	}
+	return counter.value, nil
+}
+
+func (b *MemoryBackend) Close() error {
+	return nil
+}
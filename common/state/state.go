@@ -0,0 +1,104 @@
+package state
+
+import (
+	"context"
+	"math"
+	"sync"
+	"time"
+)
+
+// Backend 多实例间共享的运行时状态: 账号状态、token缓存及限流计数
+type Backend interface {
+	// LockAccount 锁定账号至指定时间(如触发上游限速)
+	LockAccount(ctx context.Context, account string, until time.Time) error
+	// GetAccountLock 获取账号锁定的截止时间,未锁定或已过期时返回false
+	GetAccountLock(ctx context.Context, account string) (time.Time, bool, error)
+	// RemoveAccount 标记账号已移除至指定时间(如额度耗尽),到期后自动恢复
+	RemoveAccount(ctx context.Context, account string, until time.Time) error
+	// IsAccountRemoved 账号是否已被标记移除且尚未到期
+	IsAccountRemoved(ctx context.Context, account string) (bool, error)
+
+	// SetToken 缓存账号的token
+	SetToken(ctx context.Context, account string, token Token) error
+	// GetToken 获取缓存的账号token
+	GetToken(ctx context.Context, account string) (Token, bool, error)
+
+	// TakeBucket 从令牌桶中取出n个令牌,force为true时允许余额为负
+	TakeBucket(ctx context.Context, key string, n int, ratePerMinute int, burst int, force bool) (BucketResult, error)
+	// IncrCounter 计数器增加delta并刷新过期时间,返回增加后的值
+	IncrCounter(ctx context.Context, key string, delta int64, ttl time.Duration) (int64, error)
+	// GetCounter 获取计数器的值,不存在时为0
+	GetCounter(ctx context.Context, key string) (int64, error)
+
+	// Close 刷新并释放后端资源
+	Close() error
+}
+
+// Token 账号的Firebase token信息
+type Token struct {
+	ApiKey       string `json:"api_key"`
+	RefreshToken string `json:"refresh_token"`
+	AccessToken  string `json:"access_token"`
+}
+
+// BucketResult 单次取令牌的结果
+type BucketResult struct {
+	Allowed    bool
+	Limit      int
+	Remaining  int
+	RetryAfter time.Duration // 令牌不足时距可再次请求的时间
+	Reset      time.Duration // 距桶补满的时间
+}
+
+// bucketExpiration 令牌桶闲置超过该时间后视为已补满,可被清理
+const bucketExpiration = 20 * time.Minute
+
+var (
+	defaultBackend Backend = NewMemoryBackend()
+	defaultMutex   sync.RWMutex
+)
+
+// Default 获取当前使用的状态后端,未设置时为进程内存后端
+func Default() Backend {
+	defaultMutex.RLock()
+	defer defaultMutex.RUnlock()
+	return defaultBackend
+}
+
+// SetDefault 设置当前使用的状态后端
+func SetDefault(backend Backend) {
+	defaultMutex.Lock()
+	defer defaultMutex.Unlock()
+	defaultBackend = backend
+}
+
+// refillBucket 按经过的时间补充令牌并尝试取出n个,返回取出后的余额
+func refillBucket(tokens float64, elapsed time.Duration, n int, ratePerMinute int, burst int, force bool) (float64, bool) {
+	tokens = math.Min(float64(burst), tokens+elapsed.Seconds()*float64(ratePerMinute)/60)
+	allowed := tokens >= float64(n)
+	if allowed || force {
+		tokens -= float64(n)
+	}
+	return tokens, allowed
+}
+
+func newBucketResult(tokens float64, n int, ratePerMinute int, burst int, allowed bool) BucketResult {
+	ratePerSecond := float64(ratePerMinute) / 60
+	result := BucketResult{
+		Allowed:   allowed,
+		Limit:     ratePerMinute,
+		Remaining: int(math.Max(0, math.Floor(tokens))),
+		Reset:     secondsToDuration((float64(burst) - tokens) / ratePerSecond),
+	}
+	if !allowed {
+		result.RetryAfter = secondsToDuration((float64(n) - tokens) / ratePerSecond)
+	}
+	return result
+}
+
+func secondsToDuration(seconds float64) time.Duration {
+	if seconds <= 0 || math.IsInf(seconds, 0) || math.IsNaN(seconds) {
+		return 0
+	}
+	return time.Duration(seconds * float64(time.Second))
+}
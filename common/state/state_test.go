@@ -0,0 +1,285 @@
+package state
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/redis/go-redis/v9"
+)
+
+// testBackend 待测后端及推进其时间的方法
+type testBackend struct {
+	name    string
+	backend Backend
+	advance func(d time.Duration)
+}
+
+// backends 返回内存后端及基于 miniredis 的Redis后端,两者运行同一组用例以保证行为一致
+func backends(t *testing.T) []testBackend {
+	t.Helper()
+	mr := miniredis.RunT(t)
+	client := redis.NewClient(&redis.Options{Addr: mr.Addr()})
+	t.Cleanup(func() { _ = client.Close() })
+	return []testBackend{
+		{
+			name:    "memory",
+			backend: NewMemoryBackend(),
+			advance: time.Sleep,
+		},
+		{
+			name:    "redis",
+			backend: NewRedisBackend(client, "test:"),
+			advance: func(d time.Duration) {
+				// miniredis 的过期时间需手动推进,截止时间的比较依赖真实时间
+				time.Sleep(d)
+				mr.FastForward(d)
+			},
+		},
+	}
+}
+
+func TestAccountLock(t *testing.T) {
+	ctx := context.Background()
+	for _, tb := range backends(t) {
+		t.Run(tb.name, func(t *testing.T) {
+			b := tb.backend
+			if _, locked, err := b.GetAccountLock(ctx, "a"); err != nil || locked {
+				t.Fatalf("unlocked account: locked=%v err=%v", locked, err)
+			}
+
+			until := time.Now().Add(time.Hour)
+			if err := b.LockAccount(ctx, "a", until); err != nil {
+				t.Fatal(err)
+			}
+			got, locked, err := b.GetAccountLock(ctx, "a")
+			if err != nil || !locked {
+				t.Fatalf("locked account: locked=%v err=%v", locked, err)
+			}
+			if got.UnixMilli() != until.UnixMilli() {
+				t.Fatalf("lock until = %v, want %v", got, until)
+			}
+			if _, locked, _ := b.GetAccountLock(ctx, "b"); locked {
+				t.Fatal("lock leaked to another account")
+			}
+
+			// 锁定到过去的时间即解锁
+			if err := b.LockAccount(ctx, "a", time.Now().Add(-time.Second)); err != nil {
+				t.Fatal(err)
+			}
+			if _, locked, _ := b.GetAccountLock(ctx, "a"); locked {
+				t.Fatal("lock in the past should unlock")
+			}
+
+			if err := b.LockAccount(ctx, "c", time.Now().Add(50*time.Millisecond)); err != nil {
+				t.Fatal(err)
+			}
+			tb.advance(100 * time.Millisecond)
+			if _, locked, _ := b.GetAccountLock(ctx, "c"); locked {
+				t.Fatal("lock should expire")
+			}
+		})
+	}
+}
+
+func TestRemoveAccount(t *testing.T) {
+	ctx := context.Background()
+	for _, tb := range backends(t) {
+		t.Run(tb.name, func(t *testing.T) {
+			b := tb.backend
+			tests := []struct {
+				name    string
+				until   time.Duration
+				wait    time.Duration
+				removed bool
+			}{
+				{name: "active", until: time.Hour, removed: true},
+				{name: "in the past", until: -time.Second, removed: false},
+				{name: "expired", until: 50 * time.Millisecond, wait: 100 * time.Millisecond, removed: false},
+			}
+			for _, tt := range tests {
+				account := "removed-" + tt.name
+				if err := b.RemoveAccount(ctx, account, time.Now().Add(tt.until)); err != nil {
+					t.Fatal(err)
+				}
+				if tt.wait > 0 {
+					tb.advance(tt.wait)
+				}
+				removed, err := b.IsAccountRemoved(ctx, account)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if removed != tt.removed {
+					t.Errorf("%s: removed = %v, want %v", tt.name, removed, tt.removed)
+				}
+			}
+			if removed, _ := b.IsAccountRemoved(ctx, "never-removed"); removed {
+				t.Error("account that was never removed is reported as removed")
+			}
+
+			// 移除后再以过去的时间移除即恢复
+			_ = b.RemoveAccount(ctx, "restored", time.Now().Add(time.Hour))
+			_ = b.RemoveAccount(ctx, "restored", time.Now().Add(-time.Second))
+			if removed, _ := b.IsAccountRemoved(ctx, "restored"); removed {
+				t.Error("account should be restored")
+			}
+		})
+	}
+}
+
+func TestToken(t *testing.T) {
+	ctx := context.Background()
+	for _, tb := range backends(t) {
+		t.Run(tb.name, func(t *testing.T) {
+			b := tb.backend
+			if _, ok, err := b.GetToken(ctx, "a"); err != nil || ok {
+				t.Fatalf("missing token: ok=%v err=%v", ok, err)
+			}
+			// 两个账号共用同一apiKey时互不覆盖
+			tokenA := Token{ApiKey: "shared", RefreshToken: "rt-a", AccessToken: "at-a"}
+			tokenB := Token{ApiKey: "shared", RefreshToken: "rt-b", AccessToken: "at-b"}
+			if err := b.SetToken(ctx, "a", tokenA); err != nil {
+				t.Fatal(err)
+			}
+			if err := b.SetToken(ctx, "b", tokenB); err != nil {
+				t.Fatal(err)
+			}
+			for account, want := range map[string]Token{"a": tokenA, "b": tokenB} {
+				got, ok, err := b.GetToken(ctx, account)
+				if err != nil || !ok || got != want {
+					t.Errorf("GetToken(%s) = %+v, %v, %v; want %+v", account, got, ok, err, want)
+				}
+			}
+		})
+	}
+}
+
+func TestTakeBucket(t *testing.T) {
+	ctx := context.Background()
+	type take struct {
+		n         int
+		force     bool
+		allowed   bool
+		remaining int
+		retry     bool // 是否应返回 RetryAfter
+	}
+	tests := []struct {
+		name  string
+		rate  int
+		burst int
+		takes []take
+	}{
+		{
+			name: "drains burst then rejects", rate: 60, burst: 3,
+			takes: []take{
+				{n: 1, allowed: true, remaining: 2},
+				{n: 1, allowed: true, remaining: 1},
+				{n: 1, allowed: true, remaining: 0},
+				{n: 1, allowed: false, remaining: 0, retry: true},
+			},
+		},
+		{
+			name: "burst defaults to rate", rate: 2, burst: 0,
+			takes: []take{
+				{n: 2, allowed: true, remaining: 0},
+				{n: 1, allowed: false, remaining: 0, retry: true},
+			},
+		},
+		{
+			name: "multi token take", rate: 600, burst: 100,
+			takes: []take{
+				{n: 60, allowed: true, remaining: 40},
+				{n: 60, allowed: false, remaining: 40, retry: true},
+				{n: 40, allowed: true, remaining: 0},
+			},
+		},
+		{
+			name: "force goes negative", rate: 60, burst: 2,
+			takes: []take{
+				{n: 2, allowed: true, remaining: 0},
+				{n: 3, force: true, allowed: false, remaining: 0, retry: true},
+				{n: 1, allowed: false, remaining: 0, retry: true},
+			},
+		},
+		{
+			name: "more than burst never fits", rate: 60, burst: 5,
+			takes: []take{
+				{n: 6, allowed: false, remaining: 5, retry: true},
+			},
+		},
+	}
+	for _, tb := range backends(t) {
+		t.Run(tb.name, func(t *testing.T) {
+			for _, tt := range tests {
+				key := "bucket-" + tt.name
+				for i, tk := range tt.takes {
+					result, err := tb.backend.TakeBucket(ctx, key, tk.n, tt.rate, tt.burst, tk.force)
+					if err != nil {
+						t.Fatalf("%s take %d: %v", tt.name, i, err)
+					}
+					if result.Allowed != tk.allowed || result.Remaining != tk.remaining {
+						t.Errorf("%s take %d: allowed=%v remaining=%d, want allowed=%v remaining=%d",
+							tt.name, i, result.Allowed, result.Remaining, tk.allowed, tk.remaining)
+					}
+					if (result.RetryAfter > 0) != tk.retry {
+						t.Errorf("%s take %d: RetryAfter = %v, want retry=%v", tt.name, i, result.RetryAfter, tk.retry)
+					}
+					if result.Limit != tt.rate {
+						t.Errorf("%s take %d: Limit = %d, want %d", tt.name, i, result.Limit, tt.rate)
+					}
+				}
+			}
+		})
+	}
+}
+
+func TestTakeBucketRefill(t *testing.T) {
+	ctx := context.Background()
+	for _, tb := range backends(t) {
+		t.Run(tb.name, func(t *testing.T) {
+			// 每秒补充10个令牌
+			if result, _ := tb.backend.TakeBucket(ctx, "refill", 5, 600, 5, false); !result.Allowed {
+				t.Fatal("first take should be allowed")
+			}
+			if result, _ := tb.backend.TakeBucket(ctx, "refill", 1, 600, 5, false); result.Allowed {
+				t.Fatal("empty bucket should reject")
+			}
+			tb.advance(250 * time.Millisecond)
+			result, err := tb.backend.TakeBucket(ctx, "refill", 2, 600, 5, false)
+			if err != nil || !result.Allowed {
+				t.Fatalf("take after refill: %+v, %v", result, err)
+			}
+		})
+	}
+}
+
+func TestCounter(t *testing.T) {
+	ctx := context.Background()
+	for _, tb := range backends(t) {
+		t.Run(tb.name, func(t *testing.T) {
+			b := tb.backend
+			if v, err := b.GetCounter(ctx, "c"); err != nil || v != 0 {
+				t.Fatalf("missing counter = %d, %v", v, err)
+			}
+			for _, step := range []struct{ delta, want int64 }{{1, 1}, {5, 6}, {-2, 4}} {
+				v, err := b.IncrCounter(ctx, "c", step.delta, time.Hour)
+				if err != nil || v != step.want {
+					t.Fatalf("IncrCounter(%d) = %d, %v; want %d", step.delta, v, err, step.want)
+				}
+			}
+			if v, _ := b.GetCounter(ctx, "c"); v != 4 {
+				t.Fatalf("GetCounter = %d, want 4", v)
+			}
+
+			_, _ = b.IncrCounter(ctx, "short", 3, 50*time.Millisecond)
+			tb.advance(100 * time.Millisecond)
+			if v, _ := b.GetCounter(ctx, "short"); v != 0 {
+				t.Fatalf("expired counter = %d, want 0", v)
+			}
+			if v, _ := b.IncrCounter(ctx, "short", 1, time.Hour); v != 1 {
+				t.Fatalf("counter after expiry = %d, want 1", v)
+			}
+		})
+	}
+}
@@ -0,0 +1,103 @@
+package tracing
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.26.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const instrumentationName = "qodo2api"
+
+// span 公共属性
+const (
+	AttrModel      = attribute.Key("qodo.model")
+	AttrAttempt    = attribute.Key("qodo.attempt")
+	AttrErrorClass = attribute.Key("qodo.error_class")
+)
+
+// Config 追踪配置,OTLP地址、请求头等沿用 OTEL_EXPORTER_OTLP_* 标准环境变量
+type Config struct {
+	Exporter    string  // none/otlp
+	ServiceName string  // 服务名
+	SampleRatio float64 // 采样比例 0~1,上游请求携带 traceparent 时跟随上游的采样决定
+	Version     string  // 服务版本
+}
+
+// Init 按配置初始化追踪,返回用于退出时刷新剩余span的函数。
+// 未开启时仍注册 traceparent 解析,span 为无操作实现
+func Init(ctx context.Context, config Config) (func(context.Context) error, error) {
+	otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator(propagation.TraceContext{}, propagation.Baggage{}))
+
+	switch strings.ToLower(config.Exporter) {
+	case "", "none":
+		return func(context.Context) error { return nil }, nil
+	case "otlp":
+	default:
+		return nil, fmt.Errorf("unsupported trace exporter: %s", config.Exporter)
+	}
+
+	exporter, err := otlptracehttp.New(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("create OTLP trace exporter err: %v", err)
+	}
+	res, err := resource.Merge(resource.Default(), resource.NewWithAttributes(semconv.SchemaURL,
+		semconv.ServiceName(config.ServiceName),
+		semconv.ServiceVersion(config.Version),
+	))
+	if err != nil {
+		return nil, err
+	}
+	provider := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithResource(res),
+		sdktrace.WithSampler(sdktrace.ParentBased(sdktrace.TraceIDRatioBased(config.SampleRatio))),
+	)
+	otel.SetTracerProvider(provider)
+	return provider.Shutdown, nil
+}
+
+// Start 在ctx下开启子span
+func Start(ctx context.Context, name string, attrs ...attribute.KeyValue) (context.Context, trace.Span) {
+	return otel.Tracer(instrumentationName).Start(ctx, name, trace.WithAttributes(attrs...))
+}
+
+// StartServer 开启服务端span,用于入站HTTP请求
+func StartServer(ctx context.Context, name string, attrs ...attribute.KeyValue) (context.Context, trace.Span) {
+	return otel.Tracer(instrumentationName).Start(ctx, name, trace.WithAttributes(attrs...), trace.WithSpanKind(trace.SpanKindServer))
+}
+
+// End 结束span,err非nil时记录错误并标记为失败
+func End(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
+
+// SetErrorClass 在ctx当前的span上记录错误分类并标记为失败
+func SetErrorClass(ctx context.Context, class string) {
+	span := trace.SpanFromContext(ctx)
+	span.SetAttributes(AttrErrorClass.String(class))
+	span.SetStatus(codes.Error, class)
+}
+
+// Extract 从请求头中解析上游的 traceparent
+func Extract(ctx context.Context, carrier propagation.TextMapCarrier) context.Context {
+	return otel.GetTextMapPropagator().Extract(ctx, carrier)
+}
+
+// Detach 返回仅保留ctx中span信息的新ctx,用于在不继承取消信号的异步操作中关联span
+func Detach(ctx context.Context) context.Context {
+	return trace.ContextWithSpan(context.Background(), trace.SpanFromContext(ctx))
+}
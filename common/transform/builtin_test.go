@@ -0,0 +1,193 @@
+package transform
+
+import (
+	"net/url"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// contents 按顺序返回消息的角色及内容,便于比较
+func contents(messages []Message) []string {
+	result := make([]string, len(messages))
+	for i, msg := range messages {
+		result[i] = msg.Role + ":" + toString(msg.Content)
+	}
+	return result
+}
+
+func toString(content interface{}) string {
+	if s, ok := content.(string); ok {
+		return s
+	}
+	return "<non-text>"
+}
+
+func TestURLEncode(t *testing.T) {
+	req := &Request{
+		ChatInput: "你好 a&b",
+		Messages: []Message{
+			{Role: "system", Content: "be nice?"},
+			{Role: "user", Content: "q 1"},
+			{Role: "assistant", Content: []interface{}{"parts"}},
+		},
+	}
+	if err := (URLEncode{}).Transform(req); err != nil {
+		t.Fatal(err)
+	}
+	if req.ChatInput != url.QueryEscape("你好 a&b") {
+		t.Errorf("ChatInput = %q", req.ChatInput)
+	}
+	want := []string{"system:be+nice%3F", "user:q+1", "assistant:<non-text>"}
+	if got := contents(req.Messages); !reflect.DeepEqual(got, want) {
+		t.Errorf("messages = %v, want %v", got, want)
+	}
+}
+
+func TestSystemPrompt(t *testing.T) {
+	client := []Message{{Role: "system", Content: "client"}, {Role: "user", Content: "u1"}}
+	tests := []struct {
+		name     string
+		strategy string
+		messages []Message
+		want     []string
+	}{
+		{name: "prepend", strategy: StrategyPrepend, messages: client, want: []string{"system:P\n\nclient", "user:u1"}},
+		{name: "default is prepend", strategy: "", messages: client, want: []string{"system:P\n\nclient", "user:u1"}},
+		{name: "append", strategy: StrategyAppend, messages: client, want: []string{"system:client\n\nP", "user:u1"}},
+		{name: "replace", strategy: StrategyReplace, messages: client, want: []string{"system:P", "user:u1"}},
+		{name: "keep", strategy: StrategyKeep, messages: client, want: []string{"system:client", "user:u1"}},
+		{name: "no system message", strategy: StrategyKeep, messages: []Message{{Role: "user", Content: "u1"}}, want: []string{"system:P", "user:u1"}},
+		{name: "non-text system message", strategy: StrategyPrepend, messages: []Message{{Role: "system", Content: []interface{}{"x"}}}, want: []string{"system:<non-text>"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			prompt, err := NewSystemPrompt("P", "", tt.strategy)
+			if err != nil {
+				t.Fatal(err)
+			}
+			req := &Request{Messages: append([]Message(nil), tt.messages...)}
+			if err := prompt.Transform(req); err != nil {
+				t.Fatal(err)
+			}
+			if got := contents(req.Messages); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("messages = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSystemPromptTemplate(t *testing.T) {
+	prompt, err := NewSystemPrompt("{{.Date}} {{.Model}} {{.KeyLabel}}", " | ", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	req := &Request{Model: "gpt-4o", KeyLabel: "team-a"}
+	if err := prompt.Transform(req); err != nil {
+		t.Fatal(err)
+	}
+	want := time.Now().Format("2006-01-02") + " gpt-4o team-a"
+	if got := req.Messages[0].Content; got != want {
+		t.Errorf("rendered prompt = %q, want %q", got, want)
+	}
+}
+
+func TestNewSystemPromptErrors(t *testing.T) {
+	tests := []struct {
+		name, prompt, strategy, err string
+	}{
+		{name: "empty", prompt: "", err: "prompt is required"},
+		{name: "bad strategy", prompt: "x", strategy: "merge", err: "unknown strategy"},
+		{name: "unclosed action", prompt: "{{.Date", err: "invalid prompt template"},
+		{name: "unknown variable", prompt: "{{.Nope}}", err: "invalid prompt template"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := NewSystemPrompt(tt.prompt, "", tt.strategy)
+			if err == nil || !strings.Contains(err.Error(), tt.err) {
+				t.Errorf("err = %v, want %q", err, tt.err)
+			}
+		})
+	}
+}
+
+func TestPrefixMessages(t *testing.T) {
+	prefix := PrefixMessages{Messages: []Message{{Role: "user", Content: "P1"}, {Role: "assistant", Content: "P2"}}}
+	tests := []struct {
+		name     string
+		messages []Message
+		want     []string
+	}{
+		{name: "empty history", want: []string{"user:P1", "assistant:P2"}},
+		{name: "after last system message",
+			messages: []Message{{Role: "system", Content: "s1"}, {Role: "system", Content: "s2"}, {Role: "user", Content: "u1"}},
+			want:     []string{"system:s1", "system:s2", "user:P1", "assistant:P2", "user:u1"}},
+		{name: "no system message",
+			messages: []Message{{Role: "user", Content: "u1"}},
+			want:     []string{"user:P1", "assistant:P2", "user:u1"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := &Request{Messages: tt.messages}
+			if err := prefix.Transform(req); err != nil {
+				t.Fatal(err)
+			}
+			if got := contents(req.Messages); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("messages = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestPreMessages(t *testing.T) {
+	req := &Request{Messages: []Message{{Role: "user", Content: "u1"}}}
+	pre := PreMessages{Messages: []Message{{Role: "user", Content: "P1"}}}
+	if err := pre.Transform(req); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := contents(req.Messages), []string{"user:u1", "user:P1"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("messages = %q, want %q", got, want)
+	}
+}
+
+func TestChineseMode(t *testing.T) {
+	tests := []struct {
+		name      string
+		messages  []Message
+		wantFirst string // 系统消息内容的结尾
+		wantLen   int
+	}{
+		{name: "client system message is encoded after the instructions",
+			messages:  []Message{{Role: "system", Content: "be nice?"}, {Role: "assistant", Content: "a 1"}},
+			wantFirst: "!!! |be+nice%3F", wantLen: 4},
+		{name: "instructions added without client system message",
+			messages:  []Message{{Role: "assistant", Content: "a 1"}},
+			wantFirst: "default behaviors.", wantLen: 4},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := &Request{ChatInput: "问 题", Messages: tt.messages}
+			if err := ChineseMode().Transform(req); err != nil {
+				t.Fatal(err)
+			}
+			if req.ChatInput != url.QueryEscape("问 题") {
+				t.Errorf("ChatInput = %q", req.ChatInput)
+			}
+			if len(req.Messages) != tt.wantLen {
+				t.Fatalf("messages = %q", contents(req.Messages))
+			}
+			system := toString(req.Messages[0].Content)
+			if !strings.HasPrefix(system, "// AI Assistant Configuration //") || !strings.HasSuffix(system, tt.wantFirst) {
+				t.Errorf("system message = %q", system)
+			}
+			if got := toString(req.Messages[1].Content); got != "a+1" {
+				t.Errorf("history = %q, want encoded", got)
+			}
+			// 确认对话追加在末尾且不编码
+			if got := toString(req.Messages[2].Content); got != "Confirm you understand the output format." {
+				t.Errorf("pre message = %q", got)
+			}
+		})
+	}
+}
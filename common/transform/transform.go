@@ -0,0 +1,127 @@
+package transform
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// Message 上游请求中的一条历史消息
+type Message struct {
+	Role    string      `json:"role"`
+	Content interface{} `json:"content"`
+
+	// 由配置注入而非客户端发送的内容,url_encode 等只处理客户端内容
+	injected   bool   // 整条消息为注入的
+	head, tail string // 拼接在客户端系统消息首尾的注入文本
+}
+
+// clientText 消息中客户端发送的文本部分
+func (m Message) clientText() (string, bool) {
+	content, ok := m.Content.(string)
+	if !ok || m.injected || len(m.head)+len(m.tail) > len(content) {
+		return "", false
+	}
+	return content[len(m.head) : len(content)-len(m.tail)], true
+}
+
+// injectedMessages 复制配置中的消息并标记为注入的
+func injectedMessages(messages []Message) []Message {
+	result := make([]Message, len(messages))
+	for i, msg := range messages {
+		result[i] = Message{Role: msg.Role, Content: msg.Content, injected: true}
+	}
+	return result
+}
+
+// Request 发往上游前的请求: 最后一条用户消息作为 ChatInput,其余消息为历史
+type Request struct {
+	Model     string // 实际请求的模型
+	KeyLabel  string // 调用方API-KEY策略的标签
+	ChatInput string
+	Messages  []Message
+}
+
+// Transformer 请求转换器,按管道顺序依次修改请求
+type Transformer interface {
+	Transform(req *Request) error
+}
+
+// Pipeline 按顺序执行的转换器
+type Pipeline []Transformer
+
+func (p Pipeline) Transform(req *Request) error {
+	for _, t := range p {
+		if err := t.Transform(req); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Spec 转换器配置,JSON中可简写为名称字符串
+type Spec struct {
+	Name      string    `json:"name"`
+	Prompt    string    `json:"prompt,omitempty"`    // system_prompt: 注入的系统提示词模板
+	Separator string    `json:"separator,omitempty"` // system_prompt: 已有系统消息时与其拼接的分隔符
+	Strategy  string    `json:"strategy,omitempty"`  // system_prompt: 与已有系统消息的合并方式
+	Messages  []Message `json:"messages,omitempty"`  // pre_messages、prefix_messages: 插入的消息
+}
+
+func (s *Spec) UnmarshalJSON(data []byte) error {
+	var name string
+	if err := json.Unmarshal(data, &name); err == nil {
+		*s = Spec{Name: name}
+		return nil
+	}
+	type plain Spec
+	return json.Unmarshal(data, (*plain)(s))
+}
+
+// Factory 按配置创建转换器
+type Factory func(spec Spec) (Transformer, error)
+
+var (
+	registry      = make(map[string]Factory)
+	registryMutex sync.RWMutex
+)
+
+// Register 注册转换器,同名时覆盖
+func Register(name string, factory Factory) {
+	registryMutex.Lock()
+	defer registryMutex.Unlock()
+	registry[name] = factory
+}
+
+// Names 已注册的转换器名称
+func Names() []string {
+	registryMutex.RLock()
+	defer registryMutex.RUnlock()
+	names := make([]string, 0, len(registry))
+	for name := range registry {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Build 按配置顺序创建转换管道
+func Build(specs []Spec) (Pipeline, error) {
+	pipeline := make(Pipeline, 0, len(specs))
+	for _, spec := range specs {
+		registryMutex.RLock()
+		factory, ok := registry[spec.Name]
+		registryMutex.RUnlock()
+		if !ok {
+			return nil, fmt.Errorf("unknown transformer %q, available: %s", spec.Name, strings.Join(Names(), ","))
+		}
+		t, err := factory(spec)
+		if err != nil {
+			return nil, fmt.Errorf("transformer %s: %v", spec.Name, err)
+		}
+		pipeline = append(pipeline, t)
+	}
+	return pipeline, nil
+}
@@ -0,0 +1,138 @@
+package transform
+
+import (
+	"encoding/json"
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+type recordTransformer struct {
+	name  string
+	calls *[]string
+	err   error
+}
+
+func (r recordTransformer) Transform(*Request) error {
+	*r.calls = append(*r.calls, r.name)
+	return r.err
+}
+
+func TestPipelineOrder(t *testing.T) {
+	var calls []string
+	pipeline := Pipeline{
+		recordTransformer{name: "a", calls: &calls},
+		Pipeline{recordTransformer{name: "b", calls: &calls}, recordTransformer{name: "c", calls: &calls}},
+		recordTransformer{name: "d", calls: &calls, err: errors.New("stop")},
+		recordTransformer{name: "e", calls: &calls},
+	}
+	if err := pipeline.Transform(&Request{}); err == nil || err.Error() != "stop" {
+		t.Fatalf("err = %v, want stop", err)
+	}
+	if want := []string{"a", "b", "c", "d"}; !reflect.DeepEqual(calls, want) {
+		t.Errorf("calls = %v, want %v", calls, want)
+	}
+}
+
+// 全局系统提示词及前置消息先于 chinese_mode 执行,它们不应被 URL 编码,客户端内容仍需编码
+func TestGlobalInjectionNotEncodedByChineseMode(t *testing.T) {
+	global, err := Build([]Spec{
+		{Name: NameSystemPrompt, Prompt: "Global rules: be concise."},
+		{Name: NamePrefixMessages, Messages: []Message{{Role: "user", Content: "prefix question?"}, {Role: "assistant", Content: "prefix answer."}}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name     string
+		messages []Message
+		client   string // 系统消息中客户端内容编码后的形式
+	}{
+		{name: "client system message", messages: []Message{{Role: "system", Content: "client rules?"}, {Role: "user", Content: "u 1"}}, client: "client+rules%3F"},
+		{name: "no client system message", messages: []Message{{Role: "user", Content: "u 1"}}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := &Request{ChatInput: "hello world", Messages: tt.messages}
+			if err := (Pipeline{global, ChineseMode()}).Transform(req); err != nil {
+				t.Fatal(err)
+			}
+			system := toString(req.Messages[0].Content)
+			if !strings.Contains(system, "Global rules: be concise.") {
+				t.Errorf("global prompt was encoded: %q", system)
+			}
+			if !strings.HasPrefix(system, "// AI Assistant Configuration //") {
+				t.Errorf("chinese instructions should come first: %q", system)
+			}
+			if tt.client != "" && !strings.HasSuffix(system, "\n\n"+tt.client) {
+				t.Errorf("client system content should be encoded: %q", system)
+			}
+			got := contents(req.Messages[1:])
+			want := []string{"user:prefix question?", "assistant:prefix answer.", "user:u+1",
+				"user:Confirm you understand the output format.", "assistant:" + chineseAcknowledgement}
+			if !reflect.DeepEqual(got, want) {
+				t.Errorf("history = %q, want %q", got, want)
+			}
+			if req.ChatInput != "hello+world" {
+				t.Errorf("ChatInput = %q", req.ChatInput)
+			}
+		})
+	}
+}
+
+func TestSpecUnmarshal(t *testing.T) {
+	var specs []Spec
+	data := `["url_encode",{"name":"system_prompt","prompt":"P","strategy":"append"}]`
+	if err := json.Unmarshal([]byte(data), &specs); err != nil {
+		t.Fatal(err)
+	}
+	want := []Spec{{Name: NameURLEncode}, {Name: NameSystemPrompt, Prompt: "P", Strategy: StrategyAppend}}
+	if !reflect.DeepEqual(specs, want) {
+		t.Errorf("specs = %+v, want %+v", specs, want)
+	}
+}
+
+func TestBuild(t *testing.T) {
+	tests := []struct {
+		name  string
+		specs []Spec
+		len   int
+		err   string
+	}{
+		{name: "empty", len: 0},
+		{name: "builtins", specs: []Spec{{Name: NameURLEncode}, {Name: NameChineseMode}, {Name: NamePreMessages, Messages: []Message{{Role: "user", Content: "x"}}}}, len: 3},
+		{name: "unknown", specs: []Spec{{Name: "nope"}}, err: `unknown transformer "nope"`},
+		{name: "missing prompt", specs: []Spec{{Name: NameSystemPrompt}}, err: "prompt is required"},
+		{name: "missing messages", specs: []Spec{{Name: NamePrefixMessages}}, err: "messages is required"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			pipeline, err := Build(tt.specs)
+			if tt.err != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.err) {
+					t.Fatalf("err = %v, want %q", err, tt.err)
+				}
+				return
+			}
+			if err != nil || len(pipeline) != tt.len {
+				t.Fatalf("Build = %d transformers, %v; want %d", len(pipeline), err, tt.len)
+			}
+		})
+	}
+}
+
+func TestRegister(t *testing.T) {
+	var calls []string
+	Register("test_record", func(spec Spec) (Transformer, error) {
+		return recordTransformer{name: spec.Prompt, calls: &calls}, nil
+	})
+	pipeline, err := Build([]Spec{{Name: "test_record", Prompt: "custom"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = pipeline.Transform(&Request{})
+	if !reflect.DeepEqual(calls, []string{"custom"}) {
+		t.Errorf("calls = %v", calls)
+	}
+}
@@ -0,0 +1,187 @@
+package upstreamerr
+
+import (
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// Class 上游错误分类,控制器按分类决定切换账号、重试或直接返回
+type Class string
+
+const (
+	ClassNone            Class = ""                 // 不是错误
+	ClassRateLimit       Class = "rate_limit"       // 账号限速,锁定一段时间后切换账号
+	ClassUsageExhausted  Class = "usage_exhausted"  // 账号额度耗尽,移除账号后切换
+	ClassUnauthorized    Class = "unauthorized"     // token失效或未登录,切换账号
+	ClassLanguageBlocked Class = "language_blocked" // 对话语言被拒绝,直接返回
+	ClassForbidden       Class = "forbidden"        // 上游拒绝请求,直接返回
+	ClassServerError     Class = "server_error"     // 上游5xx或暂不可用,可重试
+	ClassUnknown         Class = "unknown"          // 未识别的错误,直接返回
+)
+
+var classes = map[Class]bool{
+	ClassRateLimit:       true,
+	ClassUsageExhausted:  true,
+	ClassUnauthorized:    true,
+	ClassLanguageBlocked: true,
+	ClassForbidden:       true,
+	ClassServerError:     true,
+	ClassUnknown:         true,
+}
+
+// Rule 分类规则,已配置的条件全部满足时命中,未配置的条件不参与匹配
+type Rule struct {
+	Class   Class  `json:"class"`
+	Status  int    `json:"status,omitempty"`  // HTTP状态码,0为不限
+	Code    string `json:"code,omitempty"`    // 匹配错误码(error、code、error.code、error.type)的正则
+	Message string `json:"message,omitempty"` // 匹配错误信息(message、detail、error.message,非JSON时为原始响应)的正则
+
+	code    *regexp.Regexp
+	message *regexp.Regexp
+}
+
+// DefaultRules 内置规则,按顺序匹配: 先按错误码及错误信息,再按状态码
+var DefaultRules = []Rule{
+	// 上游检测到中文对话时返回此固定内容,与状态码无关
+	{Class: ClassLanguageBlocked, Message: `^Bearer authentication is needed$`},
+	{Class: ClassUsageExhausted, Code: `(?i)usage.?limit|quota|credit`},
+	{Class: ClassRateLimit, Code: `(?i)too many|rate.?limit|concurrent`},
+	{Class: ClassUnauthorized, Code: `(?i)invalid.?token|unauthori[sz]ed|not.?logged`},
+	{Class: ClassUnauthorized, Message: `(?i)invalid token|token expired`},
+	{Class: ClassServerError, Code: `(?i)service unavailable|internal server error|bad gateway|overloaded`},
+	{Class: ClassUsageExhausted, Status: 402},
+	{Class: ClassRateLimit, Status: 429},
+	{Class: ClassUnauthorized, Status: 401},
+	{Class: ClassForbidden, Status: 403},
+}
+
+// ParseRules 解析JSON数组格式的规则并编译正则
+func ParseRules(value string) ([]Rule, error) {
+	var rules []Rule
+	if strings.TrimSpace(value) == "" {
+		return rules, nil
+	}
+	if err := json.Unmarshal([]byte(value), &rules); err != nil {
+		return nil, fmt.Errorf("invalid JSON rules: %v", err)
+	}
+	for i := range rules {
+		if err := rules[i].compile(); err != nil {
+			return nil, fmt.Errorf("rule %d: %v", i+1, err)
+		}
+	}
+	return rules, nil
+}
+
+func (r *Rule) compile() error {
+	if !classes[r.Class] {
+		return fmt.Errorf("unknown class %q", r.Class)
+	}
+	if r.Status == 0 && r.Code == "" && r.Message == "" {
+		return fmt.Errorf("class %s has no status, code or message", r.Class)
+	}
+	var err error
+	if r.Code != "" {
+		if r.code, err = regexp.Compile(r.Code); err != nil {
+			return fmt.Errorf("invalid code pattern: %v", err)
+		}
+	}
+	if r.Message != "" {
+		if r.message, err = regexp.Compile(r.Message); err != nil {
+			return fmt.Errorf("invalid message pattern: %v", err)
+		}
+	}
+	return nil
+}
+
+func (r *Rule) match(status int, e Error) bool {
+	if r.Status != 0 && r.Status != status {
+		return false
+	}
+	if r.code != nil && !r.code.MatchString(e.Code) {
+		return false
+	}
+	if r.message != nil && !r.message.MatchString(e.Message) {
+		return false
+	}
+	return true
+}
+
+// Error 从上游响应中解析出的错误
+type Error struct {
+	Code    string
+	Message string
+}
+
+// Parse 解析上游错误响应,支持 {"error":"..","message":".."}、{"error":{"code":..,"message":..}}、{"detail":".."},非JSON时原样作为错误信息
+func Parse(body string) Error {
+	body = strings.TrimSpace(body)
+	var payload map[string]interface{}
+	if err := json.Unmarshal([]byte(body), &payload); err != nil {
+		return Error{Message: body}
+	}
+	var e Error
+	switch v := payload["error"].(type) {
+	case string:
+		e.Code = v
+	case map[string]interface{}:
+		e.Code = firstString(v, "code", "type", "status")
+		e.Message = firstString(v, "message")
+	}
+	if e.Code == "" {
+		e.Code = firstString(payload, "code")
+	}
+	if e.Message == "" {
+		e.Message = firstString(payload, "message", "detail")
+	}
+	if e.Code == "" && e.Message == "" {
+		e.Message = body
+	}
+	return e
+}
+
+func firstString(m map[string]interface{}, keys ...string) string {
+	for _, key := range keys {
+		switch v := m[key].(type) {
+		case string:
+			if v != "" {
+				return v
+			}
+		case float64:
+			return fmt.Sprint(v)
+		}
+	}
+	return ""
+}
+
+// Classifier 上游错误分类器
+type Classifier struct {
+	rules []Rule
+}
+
+// New 创建分类器,rules 优先于内置规则匹配
+func New(rules []Rule) *Classifier {
+	all := append([]Rule(nil), rules...)
+	for _, rule := range DefaultRules {
+		if err := rule.compile(); err != nil {
+			panic(err)
+		}
+		all = append(all, rule)
+	}
+	return &Classifier{rules: all}
+}
+
+// Classify 按状态码及响应内容分类,未命中规则时 5xx 为 ClassServerError,其余为 ClassUnknown
+func (c *Classifier) Classify(status int, body string) Class {
+	e := Parse(body)
+	for i := range c.rules {
+		if c.rules[i].match(status, e) {
+			return c.rules[i].Class
+		}
+	}
+	if status >= 500 {
+		return ClassServerError
+	}
+	return ClassUnknown
+}
@@ -0,0 +1,137 @@
+package upstreamerr
+
+import (
+	"strings"
+	"testing"
+)
+
+// 改为规则分类前按固定内容匹配的上游错误,需保持原有分类
+func TestClassifyBaselineBodies(t *testing.T) {
+	bodies := []struct {
+		body string
+		want Class
+	}{
+		{body: `{"error":"Too many concurrent requests","message":"You have reached your maximum concurrent request limit. Please try again later."}`, want: ClassRateLimit},
+		{body: `{"error":"Usage limit exceeded","message":"You have reached your Kilo Code usage limit. Please upgrade your plan."}`, want: ClassUsageExhausted},
+		{body: `{"error":"Invalid token"}`, want: ClassUnauthorized},
+		{body: `upstream said: {"error":"Invalid token"}`, want: ClassUnauthorized},
+		{body: `{"detail":"Bearer authentication is needed"}`, want: ClassLanguageBlocked},
+	}
+	c := New(nil)
+	// 原先只按内容判断,与状态码无关
+	for _, status := range []int{200, 400, 401, 403, 429, 500} {
+		for _, tt := range bodies {
+			if got := c.Classify(status, tt.body); got != tt.want {
+				t.Errorf("Classify(%d, %s) = %q, want %q", status, tt.body, got, tt.want)
+			}
+		}
+	}
+}
+
+func TestClassify(t *testing.T) {
+	tests := []struct {
+		name   string
+		status int
+		body   string
+		want   Class
+	}{
+		{name: "402", status: 402, body: `{}`, want: ClassUsageExhausted},
+		{name: "quota code", status: 400, body: `{"error":{"code":"insufficient_quota","message":"x"}}`, want: ClassUsageExhausted},
+		{name: "429", status: 429, body: `slow down`, want: ClassRateLimit},
+		{name: "401", status: 401, body: ``, want: ClassUnauthorized},
+		{name: "token expired message", status: 400, body: `{"message":"Token expired"}`, want: ClassUnauthorized},
+		{name: "403", status: 403, body: `{"detail":"Forbidden"}`, want: ClassForbidden},
+		{name: "service unavailable code", status: 200, body: `{"error":"Service Unavailable","message":"try later"}`, want: ClassServerError},
+		{name: "5xx fallback", status: 502, body: `<html>bad gateway</html>`, want: ClassServerError},
+		{name: "5xx empty body", status: 503, body: `HTTP error status: 503`, want: ClassServerError},
+		{name: "status text without status is not 5xx", status: 0, body: `HTTP error status: 503`, want: ClassUnknown},
+		{name: "unknown", status: 400, body: `{"error":"something odd"}`, want: ClassUnknown},
+		{name: "bearer phrase inside other text is not language", status: 401, body: `{"detail":"Bearer authentication is needed for this endpoint"}`, want: ClassUnauthorized},
+		{name: "chinese word alone is not language", status: 400, body: `{"message":"chinese characters in file name"}`, want: ClassUnknown},
+	}
+	c := New(nil)
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := c.Classify(tt.status, tt.body); got != tt.want {
+				t.Errorf("Classify(%d, %q) = %q, want %q", tt.status, tt.body, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParse(t *testing.T) {
+	tests := []struct {
+		body string
+		want Error
+	}{
+		{body: `{"error":"Invalid token"}`, want: Error{Code: "Invalid token"}},
+		{body: `{"error":"E","message":"M"}`, want: Error{Code: "E", Message: "M"}},
+		{body: `{"error":{"code":"C","message":"M"}}`, want: Error{Code: "C", Message: "M"}},
+		{body: `{"error":{"type":"T"},"detail":"D"}`, want: Error{Code: "T", Message: "D"}},
+		{body: `{"code":429,"message":"M"}`, want: Error{Code: "429", Message: "M"}},
+		{body: `{"detail":"D"}`, want: Error{Message: "D"}},
+		{body: ` {"other":1} `, want: Error{Message: `{"other":1}`}},
+		{body: `plain text`, want: Error{Message: "plain text"}},
+	}
+	for _, tt := range tests {
+		if got := Parse(tt.body); got != tt.want {
+			t.Errorf("Parse(%q) = %+v, want %+v", tt.body, got, tt.want)
+		}
+	}
+}
+
+func TestParseRules(t *testing.T) {
+	tests := []struct {
+		name  string
+		value string
+		err   string
+	}{
+		{name: "empty", value: " "},
+		{name: "valid", value: `[{"class":"rate_limit","status":400,"message":"(?i)slow down"}]`},
+		{name: "invalid JSON", value: `{"class":"rate_limit"}`, err: "invalid JSON rules"},
+		{name: "unknown class", value: `[{"class":"retry","status":500}]`, err: `rule 1: unknown class "retry"`},
+		{name: "no conditions", value: `[{"class":"server_error","status":500},{"class":"forbidden"}]`, err: "rule 2: class forbidden has no status, code or message"},
+		{name: "invalid code pattern", value: `[{"class":"forbidden","code":"(unclosed"}]`, err: "rule 1: invalid code pattern"},
+		{name: "invalid message pattern", value: `[{"class":"forbidden","message":"[z-a]"}]`, err: "rule 1: invalid message pattern"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := ParseRules(tt.value)
+			if tt.err == "" {
+				if err != nil {
+					t.Fatalf("ParseRules: %v", err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.err) {
+				t.Errorf("err = %v, want %q", err, tt.err)
+			}
+		})
+	}
+}
+
+func TestCustomRulesPrecedeDefaults(t *testing.T) {
+	rules, err := ParseRules(`[{"class":"rate_limit","status":400,"message":"(?i)slow down"},{"class":"server_error","code":"^Invalid token$"}]`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := New(rules)
+	if got := c.Classify(400, `{"message":"Please slow down"}`); got != ClassRateLimit {
+		t.Errorf("custom rule = %q, want rate_limit", got)
+	}
+	if got := c.Classify(400, `{"error":"Invalid token"}`); got != ClassServerError {
+		t.Errorf("custom rule should override default, got %q", got)
+	}
+	if got := c.Classify(429, `{}`); got != ClassRateLimit {
+		t.Errorf("defaults still apply, got %q", got)
+	}
+}
+
+func TestDefaultRulesCompile(t *testing.T) {
+	for i := range DefaultRules {
+		rule := DefaultRules[i]
+		if err := rule.compile(); err != nil {
+			t.Errorf("default rule %d: %v", i+1, err)
+		}
+	}
+}
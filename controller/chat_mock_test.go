@@ -0,0 +1,149 @@
+package controller
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"qodo2api/common/config"
+	"qodo2api/common/helper"
+	google_api "qodo2api/google-api"
+	mock_server "qodo2api/mock-server"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+// mockAccount 每次运行使用新的 refresh token,避免此前运行中锁定或移除的账号影响本次结果
+func mockAccount(name string) string {
+	accountSeq++
+	return fmt.Sprintf("rt-mock-%s-%d", name, accountSeq)
+}
+
+// startMockUpstream 启动模拟上游,将 QODO_BASE_URL 及 FIREBASE_TOKEN_URL 指向它,并以 refreshTokens 初始化账号
+func startMockUpstream(t *testing.T, scenario mock_server.Scenario, refreshTokens ...string) *httptest.Server {
+	t.Helper()
+	upstream := httptest.NewServer(mock_server.NewServer(scenario).Handler())
+	t.Cleanup(upstream.Close)
+
+	oldBaseUrl, oldTokenURL, oldCookies := config.QodoBaseUrl, google_api.TokenURL, config.QDCookies
+	oldAttempts, oldBaseDelay := config.RetryMaxAttempts, config.RetryBaseDelay
+	t.Cleanup(func() {
+		config.QodoBaseUrl, google_api.TokenURL, config.QDCookies = oldBaseUrl, oldTokenURL, oldCookies
+		config.RetryMaxAttempts, config.RetryBaseDelay = oldAttempts, oldBaseDelay
+	})
+	config.QodoBaseUrl, google_api.TokenURL = upstream.URL, upstream.URL+"/v1/token"
+	config.RetryMaxAttempts, config.RetryBaseDelay = 3, 1
+
+	cookies := make([]string, len(refreshTokens))
+	for i, refreshToken := range refreshTokens {
+		cookies[i] = "key=" + refreshToken
+	}
+	t.Setenv("QD_COOKIE", strings.Join(cookies, ","))
+	if _, err := config.InitQDCookies(); err != nil {
+		t.Fatal(err)
+	}
+	return upstream
+}
+
+// mockChat 经真实HTTP服务请求对话接口,返回状态码及错误分类
+func mockChat(t *testing.T) (int, string) {
+	t.Helper()
+	var errorClass string
+	router := gin.New()
+	router.POST("/v1/chat/completions", func(c *gin.Context) {
+		c.Next()
+		errorClass = c.GetString(helper.ErrorClassKey)
+	}, ChatForOpenAI)
+	server := httptest.NewServer(router)
+	defer server.Close()
+
+	body := `{"model":"gpt-4o","stream":false,"messages":[{"role":"user","content":"Say hello"}]}`
+	resp, err := http.Post(server.URL+"/v1/chat/completions", "application/json", bytes.NewBufferString(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode == http.StatusOK && !bytes.Contains(data, []byte("Hello from the mock Qodo server.")) {
+		t.Errorf("unexpected reply: %s", data)
+	}
+	return resp.StatusCode, errorClass
+}
+
+func mockStats(t *testing.T, upstream *httptest.Server) mock_server.Stats {
+	t.Helper()
+	resp, err := http.Get(upstream.URL + "/mock/stats")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	var stats mock_server.Stats
+	if err := json.NewDecoder(resp.Body).Decode(&stats); err != nil {
+		t.Fatal(err)
+	}
+	return stats
+}
+
+func TestChatRetriesServerError(t *testing.T) {
+	account := mockAccount("retry")
+	upstream := startMockUpstream(t, mock_server.Scenario{
+		Steps: []string{mock_server.StepUnavailable, mock_server.StepOK},
+	}, account)
+
+	if code, class := mockChat(t); code != http.StatusOK || class != "upstream_server_error" {
+		t.Fatalf("status = %d, error_class = %q", code, class)
+	}
+	// 503 后同一账号重试一次成功
+	want := mock_server.Stats{
+		TokenRefreshes: 1,
+		ChatRequests:   2,
+		Steps:          map[string]int{mock_server.StepUnavailable: 1, mock_server.StepOK: 1},
+		Accounts:       map[string]int{account: 2},
+	}
+	if got := mockStats(t, upstream); !reflect.DeepEqual(got, want) {
+		t.Errorf("stats = %+v, want %+v", got, want)
+	}
+}
+
+func TestChatRotatesAccounts(t *testing.T) {
+	limited, invalid := mockAccount("limited"), mockAccount("invalid")
+	upstream := startMockUpstream(t, mock_server.Scenario{
+		Accounts: map[string][]string{
+			limited: {mock_server.StepRateLimit},
+			invalid: {mock_server.StepInvalidToken},
+		},
+	}, limited, invalid)
+
+	// 两个账号依次被限速及token失效,切换账号后仍无可用账号
+	if code, class := mockChat(t); code != http.StatusServiceUnavailable || class != "accounts_exhausted" {
+		t.Fatalf("status = %d, error_class = %q", code, class)
+	}
+	want := mock_server.Stats{
+		TokenRefreshes: 2,
+		ChatRequests:   2,
+		Steps:          map[string]int{mock_server.StepRateLimit: 1, mock_server.StepInvalidToken: 1},
+		Accounts:       map[string]int{limited: 1, invalid: 1},
+	}
+	if got := mockStats(t, upstream); !reflect.DeepEqual(got, want) {
+		t.Errorf("stats = %+v, want %+v", got, want)
+	}
+
+	// 被限速的账号已锁定,只会选中另一个账号
+	if code, class := mockChat(t); code != http.StatusOK || class != "" {
+		t.Fatalf("status = %d, error_class = %q", code, class)
+	}
+	want.ChatRequests = 3
+	want.Steps[mock_server.StepOK] = 1
+	want.Accounts[invalid] = 2
+	if got := mockStats(t, upstream); !reflect.DeepEqual(got, want) {
+		t.Errorf("stats = %+v, want %+v", got, want)
+	}
+}
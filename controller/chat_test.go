@@ -0,0 +1,138 @@
+package controller
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"qodo2api/common/audit"
+	"qodo2api/common/config"
+	"qodo2api/common/helper"
+	"qodo2api/model"
+	qodo_api "qodo2api/qodo-api"
+	"regexp"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/pkoukk/tiktoken-go"
+)
+
+var update = flag.Bool("update", false, "update golden files")
+
+// byteBpeLoader 以单字节为token的词表,测试中无需下载编码文件
+type byteBpeLoader struct{}
+
+func (byteBpeLoader) LoadTiktokenBpe(string) (map[string]int, error) {
+	ranks := make(map[string]int, 256)
+	for i := 0; i < 256; i++ {
+		ranks[string([]byte{byte(i)})] = i
+	}
+	return ranks, nil
+}
+
+func TestMain(m *testing.M) {
+	tiktoken.SetBpeLoader(byteBpeLoader{})
+	model.InitTokenEncoders()
+	gin.SetMode(gin.TestMode)
+	os.Exit(m.Run())
+}
+
+var accountSeq int
+
+// 响应中每次运行都会变化的字段
+var volatileFields = regexp.MustCompile(`"(id|created)":("[^"]*"|\d+)`)
+
+// replayChat 以回放方式请求对话接口,返回状态码、去除易变字段后的响应体及审计记录
+func replayChat(t *testing.T, replayId, body string) (int, []byte, *audit.Record) {
+	t.Helper()
+	oldDir, oldSecret, oldCookies := config.SSEReplayDir, config.BackendSecret, config.QDCookies
+	t.Cleanup(func() { config.SSEReplayDir, config.BackendSecret, config.QDCookies = oldDir, oldSecret, oldCookies })
+	config.SSEReplayDir, config.BackendSecret = filepath.Join("testdata", "fixtures"), "admin"
+	// 每次使用新账号,避免此前回放的额度耗尽等错误移除的账号影响本次结果
+	accountSeq++
+	config.QDCookies = []string{fmt.Sprintf("key=rt-test-%d", accountSeq)}
+
+	record := &audit.Record{}
+	router := gin.New()
+	router.POST("/v1/chat/completions", func(c *gin.Context) {
+		c.Set(helper.AuditRecordKey, record)
+		c.Next()
+		record.ErrorClass = c.GetString(helper.ErrorClassKey)
+	}, ChatForOpenAI)
+	// 流式响应需要 CloseNotify,使用真实的HTTP服务而非 ResponseRecorder
+	server := httptest.NewServer(router)
+	defer server.Close()
+	req, err := http.NewRequest(http.MethodPost, server.URL+"/v1/chat/completions", bytes.NewBufferString(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(qodo_api.ReplayIdHeader, replayId)
+	req.Header.Set(qodo_api.ReplaySecretHeader, "admin")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return resp.StatusCode, volatileFields.ReplaceAll(data, []byte(`"$1":"-"`)), record
+}
+
+func assertGolden(t *testing.T, name string, got []byte) {
+	t.Helper()
+	path := filepath.Join("testdata", name+".golden")
+	if *update {
+		if err := os.WriteFile(path, got, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	want, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("read golden file (run with -update to create): %v", err)
+	}
+	if !bytes.Equal(got, want) {
+		t.Errorf("response differs from %s\ngot:\n%s\nwant:\n%s", path, got, want)
+	}
+}
+
+func TestChatReplayGolden(t *testing.T) {
+	tests := []struct {
+		name       string
+		fixture    string
+		stream     bool
+		wantCode   int
+		wantFinish string // 审计记录的结束原因
+		wantClass  string // 错误分类
+	}{
+		{name: "stream", fixture: "hello", stream: true, wantCode: http.StatusOK, wantFinish: "stop"},
+		{name: "non_stream", fixture: "hello", wantCode: http.StatusOK, wantFinish: "stop"},
+		{name: "stream_rate_limited", fixture: "rate_limited", stream: true, wantCode: http.StatusServiceUnavailable, wantClass: "accounts_exhausted"},
+		{name: "non_stream_rate_limited", fixture: "rate_limited", wantCode: http.StatusServiceUnavailable, wantClass: "accounts_exhausted"},
+		// 流式响应已开始输出,以SSE错误事件结束且不记为完成
+		{name: "stream_invalid_json", fixture: "invalid_json", stream: true, wantCode: http.StatusOK, wantFinish: "error", wantClass: "upstream_invalid_response"},
+		{name: "non_stream_invalid_json", fixture: "invalid_json", wantCode: http.StatusBadGateway, wantFinish: "error", wantClass: "upstream_invalid_response"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			body := `{"model":"gpt-4o","stream":false,"messages":[{"role":"user","content":"Say hello"}]}`
+			if tt.stream {
+				body = `{"model":"gpt-4o","stream":true,"messages":[{"role":"user","content":"Say hello"}]}`
+			}
+			code, got, record := replayChat(t, tt.fixture, body)
+			if code != tt.wantCode {
+				t.Errorf("status = %d, want %d, body: %s", code, tt.wantCode, got)
+			}
+			if record.FinishReason != tt.wantFinish || record.ErrorClass != tt.wantClass {
+				t.Errorf("finish_reason = %q, error_class = %q; want %q, %q", record.FinishReason, record.ErrorClass, tt.wantFinish, tt.wantClass)
+			}
+			assertGolden(t, tt.name, got)
+		})
+	}
+}
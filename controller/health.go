@@ -0,0 +1,82 @@
+package controller
+
+import (
+	"net/http"
+	"qodo2api/common"
+	"qodo2api/common/breaker"
+	"qodo2api/common/config"
+	"qodo2api/common/lifecycle"
+	"qodo2api/common/proxypool"
+	"qodo2api/job"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// ServiceStatus 服务详细状态
+type ServiceStatus struct {
+	Status   string              `json:"status"`
+	Reasons  []string            `json:"reasons,omitempty"`
+	Version  string              `json:"version"`
+	Uptime   string              `json:"uptime"`
+	InFlight int64               `json:"in_flight"`
+	Accounts config.AccountStats `json:"accounts"`
+	Refresh  job.RefreshStatus   `json:"refresh"`
+	Circuit  breaker.Snapshot    `json:"circuit"`
+	Proxies  []proxypool.Status  `json:"proxies,omitempty"`
+}
+
+var startTime = time.Now()
+
+// serviceStatus 汇总账号池、token刷新、熔断及代理状态,任一不满足时为未就绪
+func serviceStatus() ServiceStatus {
+	status := ServiceStatus{
+		Version:  common.Version,
+		Uptime:   time.Since(startTime).Round(time.Second).String(),
+		InFlight: lifecycle.InFlight(),
+		Accounts: config.GetAccountStats(),
+		Refresh:  job.GetRefreshStatus(),
+		Circuit:  upstreamBreaker.Snapshot(),
+		Proxies:  proxypool.Stats(),
+	}
+	if !lifecycle.Ready() {
+		status.Reasons = append(status.Reasons, "shutting_down")
+	}
+	if status.Accounts.Active == 0 {
+		status.Reasons = append(status.Reasons, "no_active_accounts")
+	}
+	if status.Refresh.Failing() {
+		status.Reasons = append(status.Reasons, "token_refresh_failing")
+	}
+	if status.Circuit.State == breaker.Open {
+		status.Reasons = append(status.Reasons, "circuit_open")
+	}
+	if healthy, total := proxypool.HealthyCount(); total > 0 && healthy == 0 {
+		status.Reasons = append(status.Reasons, "no_healthy_proxies")
+	}
+	status.Status = "ready"
+	if len(status.Reasons) > 0 {
+		status.Status = "not_ready"
+	}
+	return status
+}
+
+// Healthz 存活检查,进程可响应即返回200
+func Healthz(c *gin.Context) {
+	c.JSON(http.StatusOK, gin.H{"status": "ok"})
+}
+
+// Readyz 就绪检查,关闭过程中、无可用账号、token刷新全部失败、上游熔断或代理全部被摘除时返回503
+func Readyz(c *gin.Context) {
+	status := serviceStatus()
+	code := http.StatusOK
+	if len(status.Reasons) > 0 {
+		code = http.StatusServiceUnavailable
+	}
+	c.JSON(code, gin.H{"status": status.Status, "reasons": status.Reasons})
+}
+
+// Status 详细状态: 各状态账号数量、最近一次token刷新、熔断器、代理池及版本
+func Status(c *gin.Context) {
+	c.JSON(http.StatusOK, serviceStatus())
+}
@@ -0,0 +1,38 @@
+package controller
+
+import (
+	"net/http"
+	"qodo2api/common/breaker"
+	"qodo2api/common/lifecycle"
+	"qodo2api/common/metrics"
+	"qodo2api/common/proxypool"
+	"qodo2api/cycletls"
+
+	"github.com/gin-gonic/gin"
+)
+
+func init() {
+	metrics.NewGaugeFunc("qodo_in_flight_requests", "Requests currently being served, including open streams.", func() float64 {
+		return float64(lifecycle.InFlight())
+	})
+	metrics.NewGaugeFunc("qodo_upstream_circuit_open", "Whether the upstream circuit breaker is open (1) or not (0).", func() float64 {
+		if upstreamBreaker.Snapshot().State == breaker.Open {
+			return 1
+		}
+		return 0
+	})
+	metrics.NewGaugeFunc("qodo_tls_pool_transports", "Pooled upstream transports, one per proxy and TLS fingerprint.", func() float64 {
+		return float64(cycletls.PoolStats())
+	})
+	metrics.NewGaugeFunc("qodo_proxies_healthy", "Proxies in the pool that have not been ejected.", func() float64 {
+		healthy, _ := proxypool.HealthyCount()
+		return float64(healthy)
+	})
+}
+
+// Metrics 以 Prometheus 文本格式输出指标
+func Metrics(c *gin.Context) {
+	c.Header("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	c.Status(http.StatusOK)
+	metrics.WriteText(c.Writer)
+}
@@ -2,8 +2,7 @@ package cycletls
 
 import (
 	http "github.com/Danny-Dasilva/fhttp"
-
-	"time"
+	http2 "github.com/Danny-Dasilva/fhttp/http2"
 
 	"golang.org/x/net/proxy"
 )
@@ -14,6 +13,7 @@ type Browser struct {
 	UserAgent          string
 	Cookies            []Cookie
 	InsecureSkipVerify bool
+	HTTP2Settings      *http2.HTTP2Settings
 	forceHTTP1         bool
 }
 
@@ -21,22 +21,6 @@ var disabledRedirect = func(req *http.Request, via []*http.Request) error {
 	return http.ErrUseLastResponse
 }
 
-func clientBuilder(browser Browser, dialer proxy.ContextDialer, timeout int, disableRedirect bool) http.Client {
-	//if timeout is not set in call default to 15
-	if timeout == 0 {
-		timeout = 15
-	}
-	client := http.Client{
-		Transport: newRoundTripper(browser, dialer),
-		Timeout:   time.Duration(timeout) * time.Second,
-	}
-	//if disableRedirect is set to true httpclient will not redirect
-	if disableRedirect {
-		client.CheckRedirect = disabledRedirect
-	}
-	return client
-}
-
 // NewTransport creates a new HTTP client transport that modifies HTTPS requests
 // to imitiate a specific JA3 hash and User-Agent.
 // # Example Usage
@@ -70,22 +54,3 @@ func NewTransportWithProxy(ja3 string, useragent string, proxy proxy.ContextDial
 		UserAgent: useragent,
 	}, proxy)
 }
-
-// newClient creates a new http client
-func newClient(browser Browser, timeout int, disableRedirect bool, UserAgent string, proxyURL ...string) (http.Client, error) {
-	var dialer proxy.ContextDialer
-	if len(proxyURL) > 0 && len(proxyURL[0]) > 0 {
-		var err error
-		dialer, err = newConnectDialer(proxyURL[0], UserAgent)
-		if err != nil {
-			return http.Client{
-				Timeout:       time.Duration(timeout) * time.Second,
-				CheckRedirect: disabledRedirect,
-			}, err
-		}
-	} else {
-		dialer = proxy.Direct
-	}
-
-	return clientBuilder(browser, dialer, timeout, disableRedirect), nil
-}
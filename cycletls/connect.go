@@ -337,3 +337,35 @@ func (h *http2Conn) CloseWrite() error {
 func (h *http2Conn) CloseRead() error {
 	return h.out.Close()
 }
+
+// ProbeProxy 经代理与 addr 建立TCP连接后立即关闭,用于检查代理是否可用;ctx 结束时返回其错误
+func ProbeProxy(ctx context.Context, proxyURL string, addr string) error {
+	dialer, err := newConnectDialer(proxyURL, "")
+	if err != nil {
+		return &RequestError{Op: OpProxy, Err: err}
+	}
+	type result struct {
+		conn net.Conn
+		err  error
+	}
+	// SOCKS 拨号不支持 ctx,超时由此处控制
+	done := make(chan result, 1)
+	go func() {
+		conn, err := dialer.DialContext(ctx, "tcp", addr)
+		done <- result{conn, err}
+	}()
+	select {
+	case r := <-done:
+		if r.err != nil {
+			return r.err
+		}
+		return r.conn.Close()
+	case <-ctx.Done():
+		go func() {
+			if r := <-done; r.conn != nil {
+				r.conn.Close()
+			}
+		}()
+		return ctx.Err()
+	}
+}
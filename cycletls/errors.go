@@ -1,6 +1,7 @@
 package cycletls
 
 import (
+	"errors"
 	"fmt"
 	"net"
 	"net/url"
@@ -9,6 +10,45 @@ import (
 	"strings"
 )
 
+// 构建请求失败的环节
+const (
+	OpProxy   = "proxy"   // 代理地址无效
+	OpRequest = "request" // 请求方法、地址等无效
+)
+
+// RequestError 构建请求失败,请求未发出
+type RequestError struct {
+	Op  string
+	Err error
+}
+
+func (e *RequestError) Error() string {
+	return fmt.Sprintf("invalid %s: %v", e.Op, e.Err)
+}
+
+func (e *RequestError) Unwrap() error {
+	return e.Err
+}
+
+// ConnectError 建立到上游(或经代理)的连接失败,请求未送达上游
+type ConnectError struct {
+	Err error
+}
+
+func (e *ConnectError) Error() string {
+	return fmt.Sprintf("connect failed: %v", e.Err)
+}
+
+func (e *ConnectError) Unwrap() error {
+	return e.Err
+}
+
+// Timeout 连接超时,供 url.Error 等按超时判断
+func (e *ConnectError) Timeout() bool {
+	var timeout interface{ Timeout() bool }
+	return errors.As(e.Err, &timeout) && timeout.Timeout()
+}
+
 type errorMessage struct {
 	StatusCode int
 	debugger   string
@@ -44,7 +84,8 @@ func parseError(err error) (errormessage errorMessage) {
 		return errorMessage{StatusCode: StatusCode, debugger: debugger, ErrorMsg: msg}
 	}
 	if uerr, ok := err.(*url.Error); ok {
-		if noerr, ok := uerr.Err.(*net.OpError); ok {
+		var noerr *net.OpError
+		if errors.As(uerr.Err, &noerr) {
 			op = noerr.Op
 			if SyscallError, ok := noerr.Err.(*os.SyscallError); ok {
 				if noerr.Timeout() {
@@ -1,11 +1,12 @@
 package cycletls
 
 import (
-	"bufio"
+	"context"
 	"encoding/json"
 	"flag"
 	"fmt"
 	http "github.com/Danny-Dasilva/fhttp"
+	http2 "github.com/Danny-Dasilva/fhttp/http2"
 	"github.com/gorilla/websocket"
 	"io"
 	"log"
@@ -14,7 +15,6 @@ import (
 	"os"
 	"runtime"
 	"strings"
-	"time"
 )
 
 // Options sets CycleTLS client options
@@ -33,6 +33,10 @@ type Options struct {
 	OrderAsProvided    bool              `json:"orderAsProvided"` //TODO
 	InsecureSkipVerify bool              `json:"insecureSkipVerify"`
 	ForceHTTP1         bool              `json:"forceHTTP1"`
+	// PHeaderOrder HTTP/2 伪头部顺序,未设置时按 UserAgent 推断
+	PHeaderOrder []string `json:"pHeaderOrder"`
+	// HTTP2Settings HTTP/2 连接初始的 SETTINGS 及窗口大小,未设置时按 UserAgent 推断
+	HTTP2Settings *http2.HTTP2Settings `json:"-"`
 }
 
 type cycleTLSRequest struct {
@@ -55,6 +59,7 @@ type Response struct {
 	Headers   map[string]string
 	Cookies   []*nhttp.Cookie
 	FinalUrl  string
+	Err       error `json:"-"` // 未收到响应(连接、代理或TLS失败)时的错误
 }
 
 // JSONBody converts response body to json
@@ -73,30 +78,31 @@ type CycleTLS struct {
 	RespChan chan Response
 }
 
-// ready Request
-func processRequest(request cycleTLSRequest) (result fullRequest) {
+// ready Request, ctx 取消时中断请求及响应体读取并关闭连接
+func processRequest(ctx context.Context, request cycleTLSRequest) (result fullRequest, err error) {
 	var browser = Browser{
 		JA3:                request.Options.Ja3,
 		UserAgent:          request.Options.UserAgent,
 		Cookies:            request.Options.Cookies,
 		InsecureSkipVerify: request.Options.InsecureSkipVerify,
+		HTTP2Settings:      request.Options.HTTP2Settings,
 		forceHTTP1:         request.Options.ForceHTTP1,
 	}
 
-	client, err := newClient(
+	// 同一代理及指纹的请求复用连接池中的 transport,避免每次请求重新TLS握手
+	client, err := pooledClient(
 		browser,
 		request.Options.Timeout,
 		request.Options.DisableRedirect,
-		request.Options.UserAgent,
 		request.Options.Proxy,
 	)
 	if err != nil {
-		log.Fatal(err)
+		return result, &RequestError{Op: OpProxy, Err: err}
 	}
 
-	req, err := http.NewRequest(strings.ToUpper(request.Options.Method), request.Options.URL, strings.NewReader(request.Options.Body))
+	req, err := http.NewRequestWithContext(ctx, strings.ToUpper(request.Options.Method), request.Options.URL, strings.NewReader(request.Options.Body))
 	if err != nil {
-		log.Fatal(err)
+		return result, &RequestError{Op: OpRequest, Err: err}
 	}
 	headerorder := []string{}
 	//master header order, all your headers will be ordered based on this list and anything extra will be appended to the end
@@ -152,6 +158,9 @@ func processRequest(request cycleTLSRequest) (result fullRequest) {
 
 	}
 	headerOrder := parseUserAgent(request.Options.UserAgent).HeaderOrder
+	if len(request.Options.PHeaderOrder) > 0 {
+		headerOrder = request.Options.PHeaderOrder
+	}
 
 	//ordering the pseudo headers and our normal headers
 	req.Header = http.Header{
@@ -161,7 +170,7 @@ func processRequest(request cycleTLSRequest) (result fullRequest) {
 	//set our Host header
 	u, err := url.Parse(request.Options.URL)
 	if err != nil {
-		panic(err)
+		return result, &RequestError{Op: OpRequest, Err: err}
 	}
 
 	//append our normal headers
@@ -172,12 +181,12 @@ func processRequest(request cycleTLSRequest) (result fullRequest) {
 	}
 	req.Header.Set("Host", u.Host)
 	req.Header.Set("user-agent", request.Options.UserAgent)
-	return fullRequest{req: req, client: client, options: request}
+	addCookies(req, request.Options.Cookies)
+	return fullRequest{req: req, client: client, options: request}, nil
 
 }
 
 func dispatcher(res fullRequest) (response Response, err error) {
-	defer res.client.CloseIdleConnections()
 	finalUrl := res.options.Options.URL
 	resp, err := res.client.Do(res.req)
 	if err != nil {
@@ -186,7 +195,7 @@ func dispatcher(res fullRequest) (response Response, err error) {
 
 		headers := make(map[string]string)
 		var cookies []*nhttp.Cookie
-		return Response{RequestID: res.options.RequestID, Status: parsedError.StatusCode, Body: parsedError.ErrorMsg + "-> \n" + string(err.Error()), Headers: headers, Cookies: cookies, FinalUrl: finalUrl}, nil //normally return error here
+		return Response{RequestID: res.options.RequestID, Status: parsedError.StatusCode, Body: parsedError.ErrorMsg + "-> \n" + string(err.Error()), Headers: headers, Cookies: cookies, FinalUrl: finalUrl, Err: err}, nil //normally return error here
 
 	}
 	defer resp.Body.Close()
@@ -228,32 +237,37 @@ func dispatcher(res fullRequest) (response Response, err error) {
 }
 
 // Queue queues request in worker pool
-func (client CycleTLS) Queue(URL string, options Options, Method string) {
+func (client CycleTLS) Queue(URL string, options Options, Method string) error {
 
 	options.URL = URL
 	options.Method = Method
 	//TODO add timestamp to request
 	opt := cycleTLSRequest{"Queued Request", options}
-	response := processRequest(opt)
+	response, err := processRequest(context.Background(), opt)
+	if err != nil {
+		return err
+	}
 	client.ReqChan <- response
+	return nil
 }
 
 // Do creates a single request
 func (client CycleTLS) Do(URL string, options Options, Method string) (response Response, err error) {
+	return client.DoContext(context.Background(), URL, options, Method)
+}
+
+// DoContext 同 Do,ctx 取消时中断请求
+func (client CycleTLS) DoContext(ctx context.Context, URL string, options Options, Method string) (response Response, err error) {
 
 	options.URL = URL
 	options.Method = Method
-	// Set default values if not provided
-	if options.Ja3 == "" {
-		options.Ja3 = "771,4865-4866-4867-49195-49199-49196-49200-52393-52392-49171-49172-156-157-47-53,18-35-65281-45-17513-27-65037-16-10-11-5-13-0-43-23-51,29-23-24,0"
-	}
-	if options.UserAgent == "" {
-		// Mac OS Chrome 121
-		options.UserAgent = "Mozilla/5.0 (Macintosh; Intel Mac OS X 10_15_7) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/121.0.0.0 Safari/537.36"
-	}
+	setDefaultFingerprint(&options)
 	opt := cycleTLSRequest{"cycleTLSRequest", options}
 
-	res := processRequest(opt)
+	res, err := processRequest(ctx, opt)
+	if err != nil {
+		return response, err
+	}
 	response, err = dispatcher(res)
 	if err != nil {
 		return response, err
@@ -299,25 +313,31 @@ func worker(reqChan chan fullRequest, respChan chan Response) {
 	}
 }
 
-func readSocket(reqChan chan fullRequest, c *websocket.Conn) {
+// readSocket 读取websocket请求交给工作协程,构建失败的请求直接回复错误,调用方不会一直等待
+func readSocket(reqChan chan fullRequest, respChan chan Response, c *websocket.Conn) {
 	for {
 		_, message, err := c.ReadMessage()
 		if err != nil {
 			if websocket.IsUnexpectedCloseError(err, websocket.CloseGoingAway, websocket.CloseAbnormalClosure) {
 				return
 			}
-			log.Print("Socket Error", err)
+			log.Printf("Socket Error: %v", err)
 			return
 		}
 		request := new(cycleTLSRequest)
 
 		err = json.Unmarshal(message, &request)
 		if err != nil {
-			log.Print("Unmarshal Error", err)
+			log.Printf("Unmarshal Error: %v", err)
 			return
 		}
 
-		reply := processRequest(*request)
+		reply, err := processRequest(context.Background(), *request)
+		if err != nil {
+			log.Printf("Request Error: %v", err)
+			respChan <- Response{RequestID: request.RequestID, Status: nhttp.StatusBadRequest, Body: err.Error(), Err: err}
+			continue
+		}
 
 		reqChan <- reply
 	}
@@ -381,7 +401,7 @@ func WSEndpoint(w nhttp.ResponseWriter, r *nhttp.Request) {
 		respChan := make(chan Response)
 		go workerPool(reqChan, respChan)
 
-		go readSocket(reqChan, ws)
+		go readSocket(reqChan, respChan, ws)
 		//run as main thread
 		writeSocket(respChan, ws)
 
@@ -415,6 +435,11 @@ type SSEResponse struct {
 	Data      string
 	Done      bool
 	FinalUrl  string // 添加 FinalUrl 字段
+	Raw       string // 上游原始行,用于录制;event-stream 中为组成该事件的全部行
+	Event     string // event-stream 的事件名,未指定时为 message;按行读取时为空
+	ID        string // event-stream 最近一次设置的事件ID
+	Retry     int    // event-stream 最近一次设置的重连间隔(毫秒)
+	Err       error  // 未收到响应(连接、代理或TLS失败)或读取响应中断时的错误
 }
 
 // 修改 dispatcher 函数以支持 SSE
@@ -593,21 +618,33 @@ type SSEResponse struct {
 //	}
 //}
 
-func dispatcherSSE(res fullRequest, sseChan chan<- SSEResponse) {
-	defer res.client.CloseIdleConnections()
+// dispatcherSSE 逐行读取上游SSE,ctx 取消(如客户端断开)时停止读取并关闭连接,不再发送任何事件
+func dispatcherSSE(ctx context.Context, res fullRequest, sseChan chan<- SSEResponse) {
+	send := func(response SSEResponse) bool {
+		select {
+		case sseChan <- response:
+			return true
+		case <-ctx.Done():
+			return false
+		}
+	}
 
 	finalUrl := res.options.Options.URL
 
 	resp, err := res.client.Do(res.req)
 	if err != nil {
+		if ctx.Err() != nil {
+			return
+		}
 		parsedError := parseError(err)
-		sseChan <- SSEResponse{
+		send(SSEResponse{
 			RequestID: res.options.RequestID,
 			Status:    parsedError.StatusCode,
 			Data:      fmt.Sprintf("%s-> \n%s", parsedError.ErrorMsg, err.Error()),
 			Done:      true,
 			FinalUrl:  finalUrl,
-		}
+			Err:       err,
+		})
 		return
 	}
 	defer resp.Body.Close()
@@ -616,17 +653,18 @@ func dispatcherSSE(res fullRequest, sseChan chan<- SSEResponse) {
 	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
 		bodyBytes, _ := io.ReadAll(resp.Body)
 		errorMsg := string(bodyBytes)
+		// 状态码由 Status 携带,空响应体时仅作提示文本,不应据此判断状态
 		if errorMsg == "" {
 			errorMsg = fmt.Sprintf("HTTP error status: %d", resp.StatusCode)
 		}
 
-		sseChan <- SSEResponse{
+		send(SSEResponse{
 			RequestID: res.options.RequestID,
 			Status:    resp.StatusCode,
 			Data:      errorMsg,
 			Done:      true,
 			FinalUrl:  finalUrl,
-		}
+		})
 		return
 	}
 
@@ -635,94 +673,54 @@ func dispatcherSSE(res fullRequest, sseChan chan<- SSEResponse) {
 		finalUrl = resp.Request.URL.String()
 	}
 
-	reader := bufio.NewReader(resp.Body)
-	const maxRetries = 3
-	retries := 0
-
-	for {
-		// 读取直到换行符
-		line, err := reader.ReadString('\n')
-		if err != nil {
-			if err == io.EOF {
-				break
-			}
-
-			if retries < maxRetries {
-				retries++
-				time.Sleep(time.Second * time.Duration(retries))
-				continue
-			}
-
-			sseChan <- SSEResponse{
-				RequestID: res.options.RequestID,
-				Status:    resp.StatusCode,
-				Data:      "Error reading stream: " + err.Error(),
-				Done:      true,
-				FinalUrl:  finalUrl,
-			}
-			return
-		}
-
-		// 重置重试计数
-		retries = 0
-
-		// 去除行尾的空白字符
-		line = strings.TrimSpace(line)
-
-		// 跳过空行
-		if line == "" {
-			continue
-		}
-
-		// 处理数据行
-		//if strings.HasPrefix(line, "data: ") {
-		data := strings.TrimSpace(strings.TrimPrefix(line, "data: "))
-		if data != "" {
-			sseChan <- SSEResponse{
-				RequestID: res.options.RequestID,
-				Status:    resp.StatusCode,
-				Data:      data,
-				Done:      false,
-				FinalUrl:  finalUrl,
-			}
-		}
-		//}
-
-		// 检查是否有结束标记
-		if strings.HasSuffix(line, "[DONE]") {
-			break
-		}
+	base := SSEResponse{
+		RequestID: res.options.RequestID,
+		Status:    resp.StatusCode,
+		FinalUrl:  finalUrl,
+	}
+	// text/event-stream 按规范解析,其余(如Qodo的逐行JSON)按行读取
+	var completed bool
+	if isEventStream(resp.Header.Get("Content-Type")) {
+		completed = dispatchEventStream(ctx, resp.Body, base, send)
+	} else {
+		completed = dispatchLines(ctx, resp.Body, base, send)
+	}
+	if !completed {
+		return
 	}
 
 	// 发送完成信号
-	sseChan <- SSEResponse{
+	send(SSEResponse{
 		RequestID: res.options.RequestID,
 		Status:    resp.StatusCode,
 		Data:      "[DONE]",
 		Done:      true,
 		FinalUrl:  finalUrl,
-	}
+	})
 }
 
 // 修改 Do 方法以支持 SSE
 func (client CycleTLS) DoSSE(URL string, options Options, Method string) (<-chan SSEResponse, error) {
+	return client.DoSSEContext(context.Background(), URL, options, Method)
+}
+
+// DoSSEContext 同 DoSSE,ctx 取消时中断上游读取、关闭连接并关闭返回的通道
+func (client CycleTLS) DoSSEContext(ctx context.Context, URL string, options Options, Method string) (<-chan SSEResponse, error) {
 	sseChan := make(chan SSEResponse)
 
 	options.URL = URL
 	options.Method = Method
-	if options.Ja3 == "" {
-		options.Ja3 = "771,4865-4866-4867-49195-49199-49196-49200-52393-52392-49171-49172-156-157-47-53,18-35-65281-45-17513-27-65037-16-10-11-5-13-0-43-23-51,29-23-24,0"
-	}
-	if options.UserAgent == "" {
-		options.UserAgent = "Mozilla/5.0 (Macintosh; Intel Mac OS X 10_15_7) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/121.0.0.0 Safari/537.36"
-	}
+	setDefaultFingerprint(&options)
 
 	opt := cycleTLSRequest{"cycleTLSRequest", options}
-	res := processRequest(opt)
+	res, err := processRequest(ctx, opt)
+	if err != nil {
+		return nil, err
+	}
 
 	go func() {
 		defer close(sseChan)
-		dispatcherSSE(res, sseChan)
+		dispatcherSSE(ctx, res, sseChan)
 	}()
 
 	return sseChan, nil
@@ -0,0 +1,36 @@
+package cycletls
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// 无法构建的请求应回复错误,而不是让websocket调用方一直等待
+func TestWSEndpointRepliesRequestError(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(WSEndpoint))
+	defer server.Close()
+
+	conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(server.URL, "http"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	request := cycleTLSRequest{RequestID: "req-1", Options: Options{URL: "http://127.0.0.1:1", Method: "GET", Proxy: "ftp://127.0.0.1:21"}}
+	if err := conn.WriteJSON(request); err != nil {
+		t.Fatal(err)
+	}
+	_ = conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	var response Response
+	if err := conn.ReadJSON(&response); err != nil {
+		t.Fatal(err)
+	}
+	if response.RequestID != "req-1" || response.Status != http.StatusBadRequest || !strings.Contains(response.Body, "invalid proxy") {
+		t.Errorf("response = %+v", response)
+	}
+}
@@ -0,0 +1,184 @@
+package cycletls
+
+import (
+	"sort"
+	"sync"
+	"time"
+
+	http "github.com/Danny-Dasilva/fhttp"
+	http2 "github.com/Danny-Dasilva/fhttp/http2"
+	"golang.org/x/net/proxy"
+)
+
+// PoolOptions 连接池配置
+type PoolOptions struct {
+	// MaxIdleConnsPerHost 每个 transport 对每个上游地址保留的HTTP/1.1空闲连接数,HTTP/2为单连接多路复用
+	MaxIdleConnsPerHost int
+	// IdleConnTimeout 空闲超过该时间的连接被关闭,闲置超过该时间的 transport 被移出连接池
+	IdleConnTimeout time.Duration
+	// MaxTransports 连接池中最多保留的 transport 数量(按代理、JA3、UA等区分),超出时淘汰最久未使用的
+	MaxTransports int
+}
+
+var defaultPoolOptions = PoolOptions{
+	MaxIdleConnsPerHost: 4,
+	IdleConnTimeout:     90 * time.Second,
+	MaxTransports:       64,
+}
+
+// poolKey 可共用连接的请求参数
+type poolKey struct {
+	proxy              string
+	ja3                string
+	userAgent          string
+	insecureSkipVerify bool
+	forceHTTP1         bool
+	http2Settings      *http2.HTTP2Settings // 指纹配置中的静态设置,按指针区分
+}
+
+type poolEntry struct {
+	transport *roundTripper
+	lastUsed  time.Time
+}
+
+// transportPool 按代理及指纹复用的 uTLS/HTTP2 transport,同一 transport 的请求共用已建立的连接
+type transportPool struct {
+	mutex       sync.Mutex
+	options     PoolOptions
+	entries     map[poolKey]*poolEntry
+	janitorOnce sync.Once
+}
+
+var pool = &transportPool{options: defaultPoolOptions, entries: make(map[poolKey]*poolEntry)}
+
+// SetPoolOptions 设置连接池配置,未设置(<=0)的项使用默认值,需在发出请求前调用
+func SetPoolOptions(options PoolOptions) {
+	if options.MaxIdleConnsPerHost <= 0 {
+		options.MaxIdleConnsPerHost = defaultPoolOptions.MaxIdleConnsPerHost
+	}
+	if options.IdleConnTimeout <= 0 {
+		options.IdleConnTimeout = defaultPoolOptions.IdleConnTimeout
+	}
+	if options.MaxTransports <= 0 {
+		options.MaxTransports = defaultPoolOptions.MaxTransports
+	}
+	pool.mutex.Lock()
+	defer pool.mutex.Unlock()
+	pool.options = options
+}
+
+// CloseIdleConnections 关闭连接池中全部空闲连接,进行中的请求不受影响
+func CloseIdleConnections() {
+	pool.mutex.Lock()
+	defer pool.mutex.Unlock()
+	for key, entry := range pool.entries {
+		entry.transport.CloseIdleConnections()
+		delete(pool.entries, key)
+	}
+}
+
+// PoolStats 连接池中的 transport 数量
+func PoolStats() int {
+	pool.mutex.Lock()
+	defer pool.mutex.Unlock()
+	return len(pool.entries)
+}
+
+// get 获取或创建 key 对应的 transport
+func (p *transportPool) get(key poolKey, browser Browser) (*roundTripper, error) {
+	p.janitorOnce.Do(func() {
+		go p.janitor()
+	})
+
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	if entry, ok := p.entries[key]; ok {
+		entry.lastUsed = time.Now()
+		return entry.transport, nil
+	}
+
+	dialer := proxy.ContextDialer(proxy.Direct)
+	if key.proxy != "" {
+		var err error
+		dialer, err = newConnectDialer(key.proxy, key.userAgent)
+		if err != nil {
+			return nil, err
+		}
+	}
+	rt := newRoundTripper(browser, dialer).(*roundTripper)
+	rt.maxIdleConnsPerHost = p.options.MaxIdleConnsPerHost
+	rt.idleConnTimeout = p.options.IdleConnTimeout
+	p.entries[key] = &poolEntry{transport: rt, lastUsed: time.Now()}
+	p.evictLocked(time.Now())
+	return rt, nil
+}
+
+// evictLocked 淘汰闲置超时及超出数量上限的 transport,仅关闭其空闲连接,进行中的流式响应可继续读取
+func (p *transportPool) evictLocked(now time.Time) {
+	for key, entry := range p.entries {
+		if now.Sub(entry.lastUsed) > p.options.IdleConnTimeout {
+			entry.transport.CloseIdleConnections()
+			delete(p.entries, key)
+		}
+	}
+	if len(p.entries) <= p.options.MaxTransports {
+		return
+	}
+	keys := make([]poolKey, 0, len(p.entries))
+	for key := range p.entries {
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		return p.entries[keys[i]].lastUsed.Before(p.entries[keys[j]].lastUsed)
+	})
+	for _, key := range keys[:len(keys)-p.options.MaxTransports] {
+		p.entries[key].transport.CloseIdleConnections()
+		delete(p.entries, key)
+	}
+}
+
+// janitor 定期淘汰闲置超时的 transport,HTTP/2 transport 自身不支持空闲超时
+func (p *transportPool) janitor() {
+	for {
+		p.mutex.Lock()
+		interval := p.options.IdleConnTimeout / 2
+		p.mutex.Unlock()
+		time.Sleep(interval)
+
+		p.mutex.Lock()
+		p.evictLocked(time.Now())
+		p.mutex.Unlock()
+	}
+}
+
+// pooledClient 返回使用连接池 transport 的 http.Client,超时及重定向按请求设置
+func pooledClient(browser Browser, timeout int, disableRedirect bool, proxyURL string) (http.Client, error) {
+	key := poolKey{
+		proxy:              proxyURL,
+		ja3:                browser.JA3,
+		userAgent:          browser.UserAgent,
+		insecureSkipVerify: browser.InsecureSkipVerify,
+		forceHTTP1:         browser.forceHTTP1,
+		http2Settings:      browser.HTTP2Settings,
+	}
+	// cookie 随请求变化,由 processRequest 添加到请求上,不参与连接复用
+	browser.Cookies = nil
+	rt, err := pool.get(key, browser)
+	if err != nil {
+		return http.Client{
+			Timeout:       time.Duration(timeout) * time.Second,
+			CheckRedirect: disabledRedirect,
+		}, err
+	}
+	if timeout == 0 {
+		timeout = 15
+	}
+	client := http.Client{
+		Transport: rt,
+		Timeout:   time.Duration(timeout) * time.Second,
+	}
+	if disableRedirect {
+		client.CheckRedirect = disabledRedirect
+	}
+	return client, nil
+}
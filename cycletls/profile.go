@@ -0,0 +1,143 @@
+package cycletls
+
+import (
+	"sort"
+	"strings"
+
+	http2 "github.com/Danny-Dasilva/fhttp/http2"
+)
+
+// 内置指纹名称
+const (
+	ProfileNode   = "node"   // Node.js + axios(VS Code/JetBrains 插件宿主),HTTP/1.1,无 GREASE
+	ProfileVSCode = "vscode" // VS Code(Electron/Chromium 128)
+	ProfileChrome = "chrome" // Chrome 121 (macOS)
+)
+
+// Profile 一组相互一致的客户端指纹: TLS(JA3)、HTTP/2 设置、请求头顺序及 UA
+type Profile struct {
+	Name          string
+	Ja3           string
+	UserAgent     string
+	HeaderOrder   []string             // 请求头顺序(小写),未列出的请求头排在最后
+	PHeaderOrder  []string             // HTTP/2 伪头部顺序
+	HTTP2Settings *http2.HTTP2Settings // 为 nil 时按 UserAgent 使用 fhttp 内置设置
+	Headers       map[string]string    // 该客户端固有的请求头,不覆盖调用方已设置的值
+}
+
+var profiles = map[string]*Profile{
+	ProfileNode: {
+		Name: ProfileNode,
+		// Node.js 20 默认 OpenSSL 套件,未携带 ALPN,仅使用 HTTP/1.1
+		Ja3:       "771,4866-4867-4865-49199-49195-49200-49196-158-49191-103-49192-107-163-159-52393-52392-52394-49327-49325-49315-49311-49245-49249-49239-49235-162-49326-49324-49314-49310-49244-49248-49238-49234-49188-106-49187-64-49162-49172-57-56-49161-49171-51-50-157-49313-49309-49233-156-49312-49308-49232-61-60-53-47-255,0-11-10-35-22-23-13-43-45-51,29-23-30-25-24,0-1-2",
+		UserAgent: "axios/1.7.9",
+		HeaderOrder: []string{
+			"accept",
+			"content-type",
+			"authorization",
+			"request-id",
+			"user-agent",
+			"content-length",
+			"accept-encoding",
+			"host",
+			"connection",
+		},
+		PHeaderOrder: []string{":method", ":authority", ":scheme", ":path"},
+		Headers: map[string]string{
+			"Accept-Encoding": "gzip, compress, deflate, br",
+			"Connection":      "keep-alive",
+		},
+	},
+	ProfileVSCode: {
+		Name:         ProfileVSCode,
+		Ja3:          "771,4865-4866-4867-49195-49199-49196-49200-52393-52392-49171-49172-156-157-47-53,0-23-65281-10-11-35-16-5-13-18-51-45-43-27-17513-21,29-23-24,0",
+		UserAgent:    "Mozilla/5.0 (Windows NT 10.0; Win64; x64) AppleWebKit/537.36 (KHTML, like Gecko) Code/1.96.4 Chrome/128.0.6613.186 Electron/32.2.6 Safari/537.36",
+		PHeaderOrder: []string{":method", ":authority", ":scheme", ":path"},
+		HTTP2Settings: &http2.HTTP2Settings{
+			Settings: []http2.Setting{
+				{ID: http2.SettingHeaderTableSize, Val: 65536},
+				{ID: http2.SettingEnablePush, Val: 0},
+				{ID: http2.SettingInitialWindowSize, Val: 6291456},
+				{ID: http2.SettingMaxHeaderListSize, Val: 262144},
+			},
+			ConnectionFlow: 15663105,
+		},
+		Headers: map[string]string{
+			"sec-ch-ua":          `"Not;A=Brand";v="24", "Chromium";v="128"`,
+			"sec-ch-ua-mobile":   "?0",
+			"sec-ch-ua-platform": `"Windows"`,
+			"sec-fetch-site":     "cross-site",
+			"sec-fetch-mode":     "cors",
+			"sec-fetch-dest":     "empty",
+			"Accept-Encoding":    "gzip, deflate, br",
+			"Accept-Language":    "en-US",
+		},
+	},
+	ProfileChrome: {
+		Name:         ProfileChrome,
+		Ja3:          "771,4865-4866-4867-49195-49199-49196-49200-52393-52392-49171-49172-156-157-47-53,18-35-65281-45-17513-27-65037-16-10-11-5-13-0-43-23-51,29-23-24,0",
+		UserAgent:    "Mozilla/5.0 (Macintosh; Intel Mac OS X 10_15_7) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/121.0.0.0 Safari/537.36",
+		PHeaderOrder: []string{":method", ":authority", ":scheme", ":path"},
+	},
+}
+
+// LookupProfile 按名称(不区分大小写)获取内置指纹
+func LookupProfile(name string) (Profile, bool) {
+	profile, ok := profiles[strings.ToLower(strings.TrimSpace(name))]
+	if !ok {
+		return Profile{}, false
+	}
+	return *profile, true
+}
+
+// ProfileNames 全部内置指纹名称
+func ProfileNames() []string {
+	names := make([]string, 0, len(profiles))
+	for name := range profiles {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Apply 将指纹写入请求选项,User-Agent 请求头与 TLS 指纹保持一致
+func (p Profile) Apply(options *Options) {
+	options.Ja3 = p.Ja3
+	options.UserAgent = p.UserAgent
+	options.HeaderOrder = p.HeaderOrder
+	options.PHeaderOrder = p.PHeaderOrder
+	options.HTTP2Settings = p.HTTP2Settings
+	if options.Headers == nil {
+		options.Headers = make(map[string]string, len(p.Headers))
+	}
+	for key := range options.Headers {
+		if strings.EqualFold(key, "User-Agent") {
+			delete(options.Headers, key)
+		}
+	}
+	for key, value := range p.Headers {
+		if !hasHeader(options.Headers, key) {
+			options.Headers[key] = value
+		}
+	}
+}
+
+func hasHeader(headers map[string]string, key string) bool {
+	for k := range headers {
+		if strings.EqualFold(k, key) {
+			return true
+		}
+	}
+	return false
+}
+
+// setDefaultFingerprint 未设置 JA3 或 UA 时使用 chrome 指纹
+func setDefaultFingerprint(options *Options) {
+	chrome := profiles[ProfileChrome]
+	if options.Ja3 == "" {
+		options.Ja3 = chrome.Ja3
+	}
+	if options.UserAgent == "" {
+		options.UserAgent = chrome.UserAgent
+	}
+}
@@ -8,15 +8,30 @@ import (
 
 	"strings"
 	"sync"
+	"time"
 
 	http "github.com/Danny-Dasilva/fhttp"
 	http2 "github.com/Danny-Dasilva/fhttp/http2"
 	utls "github.com/refraction-networking/utls"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
 	"golang.org/x/net/proxy"
 )
 
 var errProtocolNegotiated = errors.New("protocol negotiated")
 
+var tracer = otel.Tracer("qodo2api/cycletls")
+
+func endSpan(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
+
 type roundTripper struct {
 	sync.Mutex
 	// fix typing
@@ -28,13 +43,39 @@ type roundTripper struct {
 	cachedConnections  map[string]net.Conn
 	cachedTransports   map[string]http.RoundTripper
 
-	dialer     proxy.ContextDialer
-	forceHTTP1 bool
+	dialer        proxy.ContextDialer
+	forceHTTP1    bool
+	http2Settings *http2.HTTP2Settings
+
+	// 连接池中的 transport 保持长连接,为0时每次请求后关闭HTTP/1.1连接
+	maxIdleConnsPerHost int
+	idleConnTimeout     time.Duration
 }
 
 func (rt *roundTripper) RoundTrip(req *http.Request) (*http.Response, error) {
 	// Fix this later for proper cookie parsing
-	for _, properties := range rt.Cookies {
+	addCookies(req, rt.Cookies)
+	req.Header.Set("User-Agent", rt.UserAgent)
+	addr := rt.getDialTLSAddr(req)
+	transport := rt.transport(addr)
+	if transport == nil {
+		if err := rt.getTransport(req, addr); err != nil {
+			return nil, err
+		}
+		transport = rt.transport(addr)
+	}
+	return transport.RoundTrip(req)
+}
+
+func (rt *roundTripper) transport(addr string) http.RoundTripper {
+	rt.Lock()
+	defer rt.Unlock()
+	return rt.cachedTransports[addr]
+}
+
+// addCookies 将 Options 中的 cookie 添加到请求
+func addCookies(req *http.Request, cookies []Cookie) {
+	for _, properties := range cookies {
 		req.AddCookie(&http.Cookie{
 			Name:       properties.Name,
 			Value:      properties.Value,
@@ -49,32 +90,39 @@ func (rt *roundTripper) RoundTrip(req *http.Request) (*http.Response, error) {
 			Unparsed:   properties.Unparsed,
 		})
 	}
-	req.Header.Set("User-Agent", rt.UserAgent)
-	addr := rt.getDialTLSAddr(req)
-	if _, ok := rt.cachedTransports[addr]; !ok {
-		if err := rt.getTransport(req, addr); err != nil {
-			return nil, err
-		}
+}
+
+// newHTTP1Transport 连接池中的 transport 保留空闲连接,否则每次请求后关闭
+func (rt *roundTripper) newHTTP1Transport() *http.Transport {
+	return &http.Transport{
+		DialContext:         rt.dial,
+		DialTLSContext:      rt.dialTLS,
+		DisableKeepAlives:   rt.maxIdleConnsPerHost <= 0,
+		MaxIdleConnsPerHost: rt.maxIdleConnsPerHost,
+		IdleConnTimeout:     rt.idleConnTimeout,
 	}
-	return rt.cachedTransports[addr].RoundTrip(req)
 }
 
 func (rt *roundTripper) getTransport(req *http.Request, addr string) error {
 	switch strings.ToLower(req.URL.Scheme) {
 	case "http":
-		rt.cachedTransports[addr] = &http.Transport{DialContext: rt.dialer.DialContext, DisableKeepAlives: true}
+		rt.Lock()
+		if rt.cachedTransports[addr] == nil {
+			rt.cachedTransports[addr] = rt.newHTTP1Transport()
+		}
+		rt.Unlock()
 		return nil
 	case "https":
 	default:
 		return fmt.Errorf("invalid URL scheme: [%v]", req.URL.Scheme)
 	}
 
-	_, err := rt.dialTLS(req.Context(), "tcp", addr)
+	conn, err := rt.dialTLS(req.Context(), "tcp", addr)
 	switch err {
 	case errProtocolNegotiated:
 	case nil:
-		// Should never happen.
-		panic("dialTLS returned no error when determining cachedTransports")
+		// 并发的首个请求已建好 transport,多建立的连接直接关闭
+		_ = conn.Close()
 	default:
 		return err
 	}
@@ -82,16 +130,29 @@ func (rt *roundTripper) getTransport(req *http.Request, addr string) error {
 	return nil
 }
 
-func (rt *roundTripper) dialTLS(ctx context.Context, network, addr string) (net.Conn, error) {
-	rt.Lock()
-	defer rt.Unlock()
+// dial 建立TCP连接(经代理时含代理握手),失败时以 ConnectError 返回,便于调用方区分连接失败与读取失败
+func (rt *roundTripper) dial(ctx context.Context, network, addr string) (net.Conn, error) {
+	conn, err := rt.dialer.DialContext(ctx, network, addr)
+	if err != nil {
+		return nil, &ConnectError{Err: err}
+	}
+	return conn, nil
+}
 
+func (rt *roundTripper) dialTLS(ctx context.Context, network, addr string) (net.Conn, error) {
 	// If we have the connection from when we determined the HTTPS
-	// cachedTransports to use, return that.
+	// cachedTransports to use, return that. 仅使用一次,之后的拨号建立新连接
+	rt.Lock()
 	if conn := rt.cachedConnections[addr]; conn != nil {
+		delete(rt.cachedConnections, addr)
+		rt.Unlock()
 		return conn, nil
 	}
-	rawConn, err := rt.dialer.DialContext(ctx, network, addr)
+	rt.Unlock()
+
+	_, connectSpan := tracer.Start(ctx, "cycletls.connect", trace.WithAttributes(attribute.String("net.peer.address", addr)))
+	rawConn, err := rt.dial(ctx, network, addr)
+	endSpan(connectSpan, err)
 	if err != nil {
 		return nil, err
 	}
@@ -116,7 +177,10 @@ func (rt *roundTripper) dialTLS(ctx context.Context, network, addr string) (net.
 		return nil, err
 	}
 
-	if err = conn.Handshake(); err != nil {
+	_, handshakeSpan := tracer.Start(ctx, "cycletls.tls_handshake", trace.WithAttributes(attribute.String("tls.server_name", host)))
+	err = conn.Handshake()
+	endSpan(handshakeSpan, err)
+	if err != nil {
 		_ = conn.Close()
 
 		if err.Error() == "tls: CurvePreferences includes unsupported curve" {
@@ -126,6 +190,9 @@ func (rt *roundTripper) dialTLS(ctx context.Context, network, addr string) (net.
 		return nil, fmt.Errorf("uTlsConn.Handshake() error: %+v", err)
 	}
 
+	// 建连及握手不持有锁,避免同一 transport 的并发拨号串行
+	rt.Lock()
+	defer rt.Unlock()
 	if rt.cachedTransports[addr] != nil {
 		return conn, nil
 	}
@@ -137,14 +204,18 @@ func (rt *roundTripper) dialTLS(ctx context.Context, network, addr string) (net.
 		parsedUserAgent := parseUserAgent(rt.UserAgent)
 
 		t2 := http2.Transport{
-			DialTLS:     rt.dialTLSHTTP2,
-			PushHandler: &http2.DefaultPushHandler{},
-			Navigator:   parsedUserAgent.UserAgent,
+			DialTLS:       rt.dialTLSHTTP2,
+			PushHandler:   &http2.DefaultPushHandler{},
+			HTTP2Settings: rt.http2Settings,
+		}
+		// fhttp 仅内置 chrome、firefox 的 SETTINGS,其余客户端使用默认值
+		if parsedUserAgent.UserAgent == chrome || parsedUserAgent.UserAgent == firefox {
+			t2.Navigator = parsedUserAgent.UserAgent
 		}
 		rt.cachedTransports[addr] = &t2
 	default:
 		// Assume the remote peer is speaking HTTP 1.x + TLS.
-		rt.cachedTransports[addr] = &http.Transport{DialTLSContext: rt.dialTLS, DisableKeepAlives: true}
+		rt.cachedTransports[addr] = rt.newHTTP1Transport()
 
 	}
 
@@ -168,10 +239,17 @@ func (rt *roundTripper) getDialTLSAddr(req *http.Request) string {
 }
 
 func (rt *roundTripper) CloseIdleConnections() {
+	rt.Lock()
+	defer rt.Unlock()
 	for addr, conn := range rt.cachedConnections {
 		_ = conn.Close()
 		delete(rt.cachedConnections, addr)
 	}
+	for _, transport := range rt.cachedTransports {
+		if closer, ok := transport.(interface{ CloseIdleConnections() }); ok {
+			closer.CloseIdleConnections()
+		}
+	}
 }
 
 func newRoundTripper(browser Browser, dialer ...proxy.ContextDialer) http.RoundTripper {
@@ -186,6 +264,7 @@ func newRoundTripper(browser Browser, dialer ...proxy.ContextDialer) http.RoundT
 			cachedConnections:  make(map[string]net.Conn),
 			InsecureSkipVerify: browser.InsecureSkipVerify,
 			forceHTTP1:         browser.forceHTTP1,
+			http2Settings:      browser.HTTP2Settings,
 		}
 	}
 
@@ -198,5 +277,6 @@ func newRoundTripper(browser Browser, dialer ...proxy.ContextDialer) http.RoundT
 		cachedConnections:  make(map[string]net.Conn),
 		InsecureSkipVerify: browser.InsecureSkipVerify,
 		forceHTTP1:         browser.forceHTTP1,
+		http2Settings:      browser.HTTP2Settings,
 	}
 }
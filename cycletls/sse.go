@@ -0,0 +1,242 @@
+package cycletls
+
+import (
+	"bufio"
+	"context"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// SSEEvent 按 WHATWG event-stream 规范解析出的一个事件
+type SSEEvent struct {
+	Event string // 事件名,未指定时为 message
+	Data  string // 多行 data 以换行连接
+	ID    string // 最近一次设置的事件ID(last event ID)
+	Retry int    // 最近一次设置的重连间隔(毫秒),未设置时为0
+	Raw   string // 组成该事件的原始行
+}
+
+// sseParser text/event-stream 解析器,见 https://html.spec.whatwg.org/multipage/server-sent-events.html
+type sseParser struct {
+	reader      *bufio.Reader
+	started     bool
+	afterCR     bool // 上一行以CR结束,紧随的LF属于同一换行
+	lastEventID string
+	retry       int
+
+	event string
+	data  strings.Builder
+	raw   []string
+}
+
+func newSSEParser(r io.Reader) *sseParser {
+	return &sseParser{reader: bufio.NewReader(r)}
+}
+
+// Next 返回下一个事件;流结束时返回 io.EOF,末尾未以空行结束的事件按规范丢弃
+func (p *sseParser) Next() (SSEEvent, error) {
+	for {
+		line, err := p.readLine()
+		if err != nil {
+			return SSEEvent{}, err
+		}
+		if line == "" {
+			if event, ok := p.dispatch(); ok {
+				return event, nil
+			}
+			continue
+		}
+		if strings.HasPrefix(line, ":") {
+			// 注释行,常用于保活
+			continue
+		}
+		p.raw = append(p.raw, line)
+		p.processLine(line)
+	}
+}
+
+// readLine 读取一行,支持 CRLF、LF、CR 三种换行,并去除流开头的 BOM
+func (p *sseParser) readLine() (string, error) {
+	var line strings.Builder
+	for {
+		b, err := p.reader.ReadByte()
+		if err != nil {
+			// 未以换行结束的最后一行不构成完整事件,直接丢弃
+			return "", err
+		}
+		afterCR := p.afterCR
+		p.afterCR = false
+		switch b {
+		case '\n':
+			if afterCR && line.Len() == 0 {
+				continue
+			}
+			return p.trimBOM(line.String()), nil
+		case '\r':
+			// 不等待下一个字节,避免CR结尾的事件延迟派发
+			p.afterCR = true
+			return p.trimBOM(line.String()), nil
+		default:
+			line.WriteByte(b)
+		}
+	}
+}
+
+func (p *sseParser) trimBOM(line string) string {
+	if !p.started {
+		p.started = true
+		return strings.TrimPrefix(line, "\uFEFF")
+	}
+	return line
+}
+
+func (p *sseParser) processLine(line string) {
+	field, value, found := strings.Cut(line, ":")
+	if found {
+		value = strings.TrimPrefix(value, " ")
+	}
+	switch field {
+	case "event":
+		p.event = value
+	case "data":
+		p.data.WriteString(value)
+		p.data.WriteByte('\n')
+	case "id":
+		if !strings.Contains(value, "\x00") {
+			p.lastEventID = value
+		}
+	case "retry":
+		if value != "" && strings.Trim(value, "0123456789") == "" {
+			if retry, err := strconv.Atoi(value); err == nil {
+				p.retry = retry
+			}
+		}
+	}
+}
+
+// dispatch 遇到空行时派发已缓存的事件,data 为空时仅重置缓存
+func (p *sseParser) dispatch() (SSEEvent, bool) {
+	defer func() {
+		p.event = ""
+		p.data.Reset()
+		p.raw = nil
+	}()
+	if p.data.Len() == 0 {
+		return SSEEvent{}, false
+	}
+	event := SSEEvent{
+		Event: p.event,
+		Data:  strings.TrimSuffix(p.data.String(), "\n"),
+		ID:    p.lastEventID,
+		Retry: p.retry,
+		Raw:   strings.Join(p.raw, "\n"),
+	}
+	if event.Event == "" {
+		event.Event = "message"
+	}
+	return event, true
+}
+
+// isEventStream 响应是否为 text/event-stream
+func isEventStream(contentType string) bool {
+	mediaType, _, _ := strings.Cut(contentType, ";")
+	return strings.EqualFold(strings.TrimSpace(mediaType), "text/event-stream")
+}
+
+// dispatchEventStream 按规范逐个派发事件,data 为 [DONE] 时结束;返回 false 表示已中断,无需再发送完成信号
+func dispatchEventStream(ctx context.Context, body io.Reader, base SSEResponse, send func(SSEResponse) bool) bool {
+	parser := newSSEParser(body)
+	for {
+		event, err := parser.Next()
+		if err != nil {
+			if err == io.EOF {
+				return true
+			}
+			if ctx.Err() == nil {
+				response := base
+				response.Data = "Error reading stream: " + err.Error()
+				response.Done = true
+				response.Err = err
+				send(response)
+			}
+			return false
+		}
+		if event.Data == "[DONE]" {
+			return true
+		}
+		response := base
+		response.Data = event.Data
+		response.Event = event.Event
+		response.ID = event.ID
+		response.Retry = event.Retry
+		response.Raw = event.Raw
+		if !send(response) {
+			return false
+		}
+	}
+}
+
+// dispatchLines 兼容非 event-stream 的逐行响应: 每个非空行为一条消息,去除可选的 "data: " 前缀,跳过注释行,以 [DONE] 结尾的行结束
+func dispatchLines(ctx context.Context, body io.Reader, base SSEResponse, send func(SSEResponse) bool) bool {
+	reader := bufio.NewReader(body)
+	const maxRetries = 3
+	retries := 0
+
+	for {
+		// 读取直到换行符
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			if err == io.EOF {
+				return true
+			}
+			if ctx.Err() != nil {
+				return false
+			}
+
+			if retries < maxRetries {
+				retries++
+				select {
+				case <-time.After(time.Second * time.Duration(retries)):
+				case <-ctx.Done():
+					return false
+				}
+				continue
+			}
+
+			response := base
+			response.Data = "Error reading stream: " + err.Error()
+			response.Done = true
+			response.Err = err
+			send(response)
+			return false
+		}
+
+		// 重置重试计数
+		retries = 0
+
+		// 去除行尾的空白字符
+		line = strings.TrimSpace(line)
+
+		// 跳过空行及注释行
+		if line == "" || strings.HasPrefix(line, ":") {
+			continue
+		}
+
+		data := strings.TrimSpace(strings.TrimPrefix(line, "data: "))
+		if data != "" {
+			response := base
+			response.Data = data
+			response.Raw = line
+			if !send(response) {
+				return false
+			}
+		}
+
+		// 检查是否有结束标记
+		if strings.HasSuffix(line, "[DONE]") {
+			return true
+		}
+	}
+}
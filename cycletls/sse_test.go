@@ -0,0 +1,233 @@
+package cycletls
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// 上游在发送首个事件前断开连接时,应以带 Err 的完成事件结束,控制器据此按网络错误重试
+func TestDoSSEConnectionDropped(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, buf, err := w.(http.Hijacker).Hijack()
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		defer conn.Close()
+		// 分块编码的响应在块未写完时断开
+		_, _ = buf.WriteString("HTTP/1.1 200 OK\r\nContent-Type: text/event-stream\r\nTransfer-Encoding: chunked\r\n\r\n10\r\ndata: {\"par")
+		_ = buf.Flush()
+	}))
+	defer server.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	sseChan, err := Init().DoSSEContext(ctx, server.URL, Options{Timeout: 5}, http.MethodPost)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var responses []SSEResponse
+	for response := range sseChan {
+		responses = append(responses, response)
+	}
+	if len(responses) != 1 {
+		t.Fatalf("responses = %+v, want a single error", responses)
+	}
+	response := responses[0]
+	if !response.Done || response.Err == nil || response.Data == "[DONE]" {
+		t.Errorf("response = %+v, want Done with Err", response)
+	}
+	var connectErr *ConnectError
+	if errors.As(response.Err, &connectErr) {
+		t.Errorf("read error after connecting reported as ConnectError: %v", response.Err)
+	}
+}
+
+// 非2xx响应以带真实状态码的完成事件结束,空响应体时同样如此
+func TestDoSSEErrorStatus(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer server.Close()
+
+	sseChan, err := Init().DoSSEContext(context.Background(), server.URL, Options{Timeout: 5}, http.MethodPost)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var responses []SSEResponse
+	for response := range sseChan {
+		responses = append(responses, response)
+	}
+	if len(responses) != 1 || !responses[0].Done || responses[0].Status != http.StatusServiceUnavailable || responses[0].Err != nil {
+		t.Fatalf("responses = %+v, want a single 503", responses)
+	}
+}
+
+// 连接失败以 ConnectError 区分于连接建立后的读取错误,调用方据此判断代理是否可用
+func TestDoSSEConnectError(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := listener.Addr().String()
+	listener.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	sseChan, err := Init().DoSSEContext(ctx, "http://"+addr, Options{Timeout: 5}, http.MethodPost)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var responses []SSEResponse
+	for response := range sseChan {
+		responses = append(responses, response)
+	}
+	var connectErr *ConnectError
+	if len(responses) != 1 || !errors.As(responses[0].Err, &connectErr) {
+		t.Fatalf("responses = %+v, want a single ConnectError", responses)
+	}
+}
+
+func TestSSEParser(t *testing.T) {
+	tests := []struct {
+		name  string
+		input string
+		want  []SSEEvent
+	}{
+		{
+			name:  "LF",
+			input: "data: a\n\ndata: b\n\n",
+			want:  []SSEEvent{{Event: "message", Data: "a", Raw: "data: a"}, {Event: "message", Data: "b", Raw: "data: b"}},
+		},
+		{
+			name:  "CRLF",
+			input: "event: delta\r\ndata: a\r\n\r\ndata: b\r\n\r\n",
+			want:  []SSEEvent{{Event: "delta", Data: "a", Raw: "event: delta\ndata: a"}, {Event: "message", Data: "b", Raw: "data: b"}},
+		},
+		{
+			name:  "CR",
+			input: "data: a\r\rdata: b\r\r",
+			want:  []SSEEvent{{Event: "message", Data: "a", Raw: "data: a"}, {Event: "message", Data: "b", Raw: "data: b"}},
+		},
+		{
+			name:  "mixed line endings",
+			input: "data: a\r\ndata: b\rdata: c\n\r\n",
+			want:  []SSEEvent{{Event: "message", Data: "a\nb\nc", Raw: "data: a\ndata: b\ndata: c"}},
+		},
+		{
+			name:  "leading BOM",
+			input: "\uFEFFdata: a\n\n",
+			want:  []SSEEvent{{Event: "message", Data: "a", Raw: "data: a"}},
+		},
+		{
+			name:  "BOM only stripped at stream start",
+			input: "data: a\n\n\uFEFFdata: b\n\n",
+			want:  []SSEEvent{{Event: "message", Data: "a", Raw: "data: a"}},
+		},
+		{
+			name:  "comment lines",
+			input: ": keep-alive\ndata: a\n:another\n\n: ping\n\n",
+			want:  []SSEEvent{{Event: "message", Data: "a", Raw: "data: a"}},
+		},
+		{
+			name:  "multi-line data",
+			input: "data: line1\ndata:line2\ndata\ndata:  indented\n\n",
+			want:  []SSEEvent{{Event: "message", Data: "line1\nline2\n\n indented", Raw: "data: line1\ndata:line2\ndata\ndata:  indented"}},
+		},
+		{
+			name:  "id sets last event id for later events",
+			input: "id: 1\ndata: a\n\ndata: b\n\nid\ndata: c\n\n",
+			want: []SSEEvent{
+				{Event: "message", Data: "a", ID: "1", Raw: "id: 1\ndata: a"},
+				{Event: "message", Data: "b", ID: "1", Raw: "data: b"},
+				{Event: "message", Data: "c", Raw: "id\ndata: c"},
+			},
+		},
+		{
+			name:  "id containing NUL is ignored",
+			input: "id: 1\ndata: a\n\nid: 2\x003\ndata: b\n\n",
+			want: []SSEEvent{
+				{Event: "message", Data: "a", ID: "1", Raw: "id: 1\ndata: a"},
+				{Event: "message", Data: "b", ID: "1", Raw: "id: 2\x003\ndata: b"},
+			},
+		},
+		{
+			name:  "retry",
+			input: "retry: 3000\ndata: a\n\nretry: 3s\ndata: b\n\nretry: -1\nretry\ndata: c\n\n",
+			want: []SSEEvent{
+				{Event: "message", Data: "a", Retry: 3000, Raw: "retry: 3000\ndata: a"},
+				{Event: "message", Data: "b", Retry: 3000, Raw: "retry: 3s\ndata: b"},
+				{Event: "message", Data: "c", Retry: 3000, Raw: "retry: -1\nretry\ndata: c"},
+			},
+		},
+		{
+			name:  "event without data is not dispatched",
+			input: "event: ping\n\ndata: a\n\n",
+			want:  []SSEEvent{{Event: "message", Data: "a", Raw: "data: a"}},
+		},
+		{
+			name:  "unknown fields ignored",
+			input: "foo: bar\ndata: a\n\n",
+			want:  []SSEEvent{{Event: "message", Data: "a", Raw: "foo: bar\ndata: a"}},
+		},
+		{
+			name:  "trailing event without blank line is discarded",
+			input: "data: a\n\ndata: b\n",
+			want:  []SSEEvent{{Event: "message", Data: "a", Raw: "data: a"}},
+		},
+		{
+			name:  "trailing line without newline is discarded",
+			input: "data: a\n\ndata: b",
+			want:  []SSEEvent{{Event: "message", Data: "a", Raw: "data: a"}},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			parser := newSSEParser(strings.NewReader(tt.input))
+			var got []SSEEvent
+			for {
+				event, err := parser.Next()
+				if err == io.EOF {
+					break
+				}
+				if err != nil {
+					t.Fatal(err)
+				}
+				got = append(got, event)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("events = %q\nwant     %q", got, tt.want)
+			}
+		})
+	}
+}
+
+// CR结尾的事件应立即派发,不等待可能跟随的LF
+func TestSSEParserCRDoesNotBlock(t *testing.T) {
+	reader, writer := io.Pipe()
+	defer writer.Close()
+	parser := newSSEParser(reader)
+	go func() { _, _ = writer.Write([]byte("data: a\r\r")) }()
+
+	done := make(chan SSEEvent)
+	go func() {
+		event, _ := parser.Next()
+		done <- event
+	}()
+	select {
+	case event := <-done:
+		if event.Data != "a" {
+			t.Errorf("event = %+v", event)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("event terminated by CR was not dispatched")
+	}
+}
@@ -18,6 +18,7 @@ import (
 const (
 	chrome  = "chrome"  //chrome User agent enum
 	firefox = "firefox" //firefox User agent enum
+	node    = "node"    //node.js(axios等) User agent enum,不带GREASE
 )
 
 type UserAgent struct {
@@ -32,6 +33,8 @@ func parseUserAgent(userAgent string) UserAgent {
 		return UserAgent{chrome, []string{":method", ":authority", ":scheme", ":path"}}
 	case strings.Contains(strings.ToLower(userAgent), "firefox"):
 		return UserAgent{firefox, []string{":method", ":path", ":authority", ":scheme"}}
+	case strings.Contains(strings.ToLower(userAgent), "axios"), strings.HasPrefix(strings.ToLower(userAgent), "node"):
+		return UserAgent{node, []string{":method", ":authority", ":scheme", ":path"}}
 	default:
 		return UserAgent{chrome, []string{":method", ":authority", ":scheme", ":path"}}
 	}
@@ -180,6 +183,9 @@ func StringToSpec(ja3 string, userAgent string, forceHTTP1 bool) (*utls.ClientHe
 	}
 	tlsMaxVersion, tlsMinVersion, tlsExtension, err := createTlsVersion(uint16(ver))
 	extMap["43"] = tlsExtension
+	if parsedUserAgent.UserAgent == node {
+		removeGREASE(extMap)
+	}
 
 	// build extenions list
 	var exts []utls.TLSExtension
@@ -225,6 +231,28 @@ func StringToSpec(ja3 string, userAgent string, forceHTTP1 bool) (*utls.ClientHe
 	}, nil
 }
 
+// removeGREASE 非浏览器客户端(node)的 ClientHello 不含 GREASE
+func removeGREASE(extMap map[string]utls.TLSExtension) {
+	if supportedVersions, ok := extMap["43"].(*utls.SupportedVersionsExtension); ok {
+		versions := make([]uint16, 0, len(supportedVersions.Versions))
+		for _, v := range supportedVersions.Versions {
+			if v != utls.GREASE_PLACEHOLDER {
+				versions = append(versions, v)
+			}
+		}
+		supportedVersions.Versions = versions
+	}
+	if keyShare, ok := extMap["51"].(*utls.KeyShareExtension); ok {
+		keyShares := make([]utls.KeyShare, 0, len(keyShare.KeyShares))
+		for _, k := range keyShare.KeyShares {
+			if k.Group != utls.CurveID(utls.GREASE_PLACEHOLDER) {
+				keyShares = append(keyShares, k)
+			}
+		}
+		keyShare.KeyShares = keyShares
+	}
+}
+
 // TLSVersion，Ciphers，Extensions，EllipticCurves，EllipticCurvePointFormats
 func createTlsVersion(ver uint16) (tlsMaxVersion uint16, tlsMinVersion uint16, tlsSuppor utls.TLSExtension, err error) {
 	switch ver {
@@ -1,12 +1,17 @@
 package google_api
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
-	"io"
 	"net/http"
 	"net/url"
-	"strings"
+	"qodo2api/common/env"
+	"qodo2api/common/proxypool"
+	"qodo2api/common/retry"
+	"qodo2api/common/tracing"
+	"qodo2api/cycletls"
 	"time"
 )
 
@@ -14,6 +19,8 @@ import (
 type RefreshTokenRequest struct {
 	Key          string
 	RefreshToken string
+	Proxy        string           // proxy for the account, empty for a direct connection
+	Profile      cycletls.Profile // client fingerprint for the account
 }
 
 // TokenResponse represents the output from the token endpoint
@@ -27,48 +34,125 @@ type TokenResponse struct {
 	ProjectID    string `json:"project_id"`
 }
 
-// GetFirebaseToken refreshes a Firebase token using the refresh token
-func GetFirebaseToken(req RefreshTokenRequest) (*TokenResponse, error) {
-	// Prepare request
-	apiURL := "https://securetoken.googleapis.com/v1/token"
+// TokenURL is the Firebase securetoken endpoint, configurable via FIREBASE_TOKEN_URL for offline testing
+var TokenURL = env.String("FIREBASE_TOKEN_URL", "https://securetoken.googleapis.com/v1/token")
+
+// MaxAttempts is the number of attempts for a token refresh, configurable via FIREBASE_REFRESH_MAX_ATTEMPTS
+var MaxAttempts = env.Int("FIREBASE_REFRESH_MAX_ATTEMPTS", 3)
+
+// RetryBackoff is the delay before the first retry, doubled on each further retry with jitter, configurable via FIREBASE_REFRESH_BACKOFF_MS
+var RetryBackoff = time.Duration(env.Int("FIREBASE_REFRESH_BACKOFF_MS", 1000)) * time.Millisecond
+
+// TokenError is returned when the token endpoint answers with a non-2xx status
+type TokenError struct {
+	Status  int
+	Message string
+}
+
+func (e *TokenError) Error() string {
+	return fmt.Sprintf("token endpoint returned %d: %s", e.Status, e.Message)
+}
+
+// Temporary reports whether the request may succeed on retry (rate limited or server error)
+func (e *TokenError) Temporary() bool {
+	return e.Status == http.StatusTooManyRequests || e.Status >= 500
+}
+
+// GetFirebaseToken refreshes a Firebase token using the refresh token, sent through cycletls
+// with the same proxy and fingerprint as chat requests. Network errors, 429 and 5xx are retried
+// with exponential backoff; an invalid refresh token fails immediately.
+func GetFirebaseToken(ctx context.Context, req RefreshTokenRequest) (tokenResponse *TokenResponse, err error) {
+	ctx, span := tracing.Start(ctx, "firebase.refresh_token")
+	defer func() {
+		tracing.End(span, err)
+	}()
+
+	attempts := MaxAttempts
+	if attempts < 1 {
+		attempts = 1
+	}
+	for attempt := 1; ; attempt++ {
+		tokenResponse, err = refreshToken(ctx, req)
+		if err == nil || attempt >= attempts || !retryable(err) {
+			return tokenResponse, err
+		}
+		timer := time.NewTimer(retry.Backoff(attempt, RetryBackoff, 0))
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return nil, err
+		case <-timer.C:
+		}
+	}
+}
+
+func retryable(err error) bool {
+	var tokenErr *TokenError
+	if errors.As(err, &tokenErr) {
+		return tokenErr.Temporary()
+	}
+	var requestErr *cycletls.RequestError
+	return !errors.As(err, &requestErr)
+}
+
+func refreshToken(ctx context.Context, req RefreshTokenRequest) (*TokenResponse, error) {
 	data := url.Values{}
 	data.Set("grant_type", "refresh_token")
 	data.Set("refresh_token", req.RefreshToken)
 
-	request, err := http.NewRequest("POST", apiURL+"?key="+req.Key, strings.NewReader(data.Encode()))
-	if err != nil {
-		return nil, fmt.Errorf("failed to create request: %v err: %v", request, err)
+	options := cycletls.Options{
+		Timeout: 10,
+		Proxy:   req.Proxy,
+		Body:    data.Encode(),
+		Headers: map[string]string{
+			"Content-Type":     "application/x-www-form-urlencoded",
+			"X-Client-Version": "Node/JsCore/10.5.2/FirebaseCore-web",
+			"X-Firebase-gmpid": "1:252179682924:web:9c80c6a32cb4682cbfaa49",
+		},
 	}
+	req.Profile.Apply(&options)
 
-	// Set headers exactly as in the curl command
-	request.Header.Set("User-Agent", "node-fetch/1.0 (+https://github.com/bitinn/node-fetch)")
-	request.Header.Set("Connection", "close")
-	request.Header.Set("Accept-Encoding", "deflate")
-	request.Header.Set("Content-Type", "application/x-www-form-urlencoded")
-	request.Header.Set("X-Client-Version", "Node/JsCore/10.5.2/FirebaseCore-web")
-	request.Header.Set("X-Firebase-gmpid", "1:252179682924:web:9c80c6a32cb4682cbfaa49")
-
-	// Send request with timeout
-	client := &http.Client{
-		Timeout: 10 * time.Second,
-	}
-	resp, err := client.Do(request)
+	resp, err := cycletls.CycleTLS{}.DoContext(ctx, TokenURL+"?key="+url.QueryEscape(req.Key), options, "POST")
 	if err != nil {
-		return nil, fmt.Errorf("request failed: %v", err)
+		return nil, fmt.Errorf("failed to create request: %w", err)
+	}
+	if resp.Err != nil {
+		if req.Proxy != "" {
+			proxypool.ReportFailure(req.Proxy, resp.Err)
+		}
+		return nil, fmt.Errorf("request failed: %w", resp.Err)
+	}
+	if req.Proxy != "" {
+		proxypool.ReportSuccess(req.Proxy)
 	}
-	defer resp.Body.Close()
 
-	body, err := io.ReadAll(resp.Body)
-	if err != nil {
-		return nil, fmt.Errorf("failed to read response body: %v", err)
+	if resp.Status < 200 || resp.Status >= 300 {
+		return nil, &TokenError{Status: resp.Status, Message: errorMessage(resp.Body)}
 	}
 
 	// Parse JSON response
-	var tokenResponse TokenResponse
-	err = json.Unmarshal(body, &tokenResponse)
-	if err != nil {
+	tokenResponse := &TokenResponse{}
+	if err := json.Unmarshal([]byte(resp.Body), tokenResponse); err != nil {
 		return nil, fmt.Errorf("failed to parse JSON response: %v", err)
 	}
+	if tokenResponse.AccessToken == "" {
+		return nil, errors.New("token endpoint returned no access token")
+	}
+	return tokenResponse, nil
+}
 
-	return &tokenResponse, nil
+// errorMessage extracts error.message from a Google API error body, falling back to the raw body
+func errorMessage(body string) string {
+	var payload struct {
+		Error struct {
+			Message string `json:"message"`
+		} `json:"error"`
+	}
+	if json.Unmarshal([]byte(body), &payload) == nil && payload.Error.Message != "" {
+		return payload.Error.Message
+	}
+	if len(body) > 200 {
+		body = body[:200]
+	}
+	return body
 }
@@ -1,43 +1,88 @@
 package job
 
 import (
+	"context"
 	"fmt"
 	"github.com/deanxv/CycleTLS/cycletls"
 	"qodo2api/common/config"
 	logger "qodo2api/common/loggger"
+	"qodo2api/common/proxypool"
+	"qodo2api/common/secret"
 	google_api "qodo2api/google-api"
 	"strings"
+	"sync"
 	"time"
 )
 
-func UpdateCookieTokenTask() {
+// RefreshStatus 最近一轮cookie token刷新的结果
+type RefreshStatus struct {
+	LastRun     time.Time `json:"last_run"`
+	LastSuccess time.Time `json:"last_success"`
+	Succeeded   int       `json:"succeeded"`
+	Failed      int       `json:"failed"`
+}
+
+// Failing 最近一轮的刷新全部失败
+func (s RefreshStatus) Failing() bool {
+	return s.Failed > 0 && s.Succeeded == 0
+}
+
+var (
+	refreshStatus      RefreshStatus
+	refreshStatusMutex sync.RWMutex
+)
+
+// GetRefreshStatus 获取最近一轮刷新的结果,尚未执行时 LastRun 为零值
+func GetRefreshStatus() RefreshStatus {
+	refreshStatusMutex.RLock()
+	defer refreshStatusMutex.RUnlock()
+	return refreshStatus
+}
+
+// UpdateCookieTokenTask 每10分钟刷新一次cookie token,ctx取消后在当前一轮结束时退出
+func UpdateCookieTokenTask(ctx context.Context) {
 	client := cycletls.Init()
 	defer safeClose(client)
 	for {
 		logger.SysLog("qodo2api Scheduled UpdateCookieTokenTask Task Job Start!")
+		succeeded, failed := 0, 0
 
 		for _, cookie := range config.NewCookieManager().Cookies {
+			if ctx.Err() != nil {
+				break
+			}
 			split := strings.Split(cookie, "=")
-			tokenInfo, ok := config.QDTokenMap[split[0]]
+			tokenInfo, ok := config.GetQDTokenInfo(cookie)
 			if ok {
 				request := google_api.RefreshTokenRequest{
 					Key:          tokenInfo.ApiKey,
 					RefreshToken: tokenInfo.RefreshToken,
+					Proxy:        proxypool.Get(cookie),
+					Profile:      config.SelectTLSProfile(cookie),
 				}
-				token, err := google_api.GetFirebaseToken(request)
+				// 不随 ctx 取消,正在进行的一轮刷新不会被打断
+				token, err := google_api.GetFirebaseToken(context.Background(), request)
 				if err != nil {
-					logger.SysError(fmt.Sprintf("GetFirebaseToken err: %v Req: %v", err, request))
+					logger.SysError(fmt.Sprintf("GetFirebaseToken err: %v Cookie: %s", err, secret.MaskCookie(cookie)))
+					failed++
 				} else {
-					config.QDTokenMap[split[0]] = config.QDTokenInfo{
+					err = config.SetQDTokenInfo(cookie, config.QDTokenInfo{
 						ApiKey:       split[0],
 						RefreshToken: token.RefreshToken,
 						AccessToken:  token.AccessToken,
+					})
+					if err != nil {
+						logger.SysError(fmt.Sprintf("SetQDTokenInfo err: %v", err))
+						failed++
+					} else {
+						succeeded++
 					}
 				}
 			}
 
 		}
 
+		recordRefresh(succeeded, failed)
 		logger.SysLog("qodo2api Scheduled UpdateCookieTokenTask Task Job End!")
 
 		now := time.Now()
@@ -48,9 +93,29 @@ func UpdateCookieTokenTask() {
 		}
 		next := now.Add(time.Duration(minutesToAdd) * time.Minute)
 		next = time.Date(next.Year(), next.Month(), next.Day(), next.Hour(), next.Minute(), 0, 0, next.Location())
-		time.Sleep(next.Sub(now))
+		timer := time.NewTimer(next.Sub(now))
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			logger.SysLog("qodo2api Scheduled UpdateCookieTokenTask Task Job Stopped!")
+			return
+		case <-timer.C:
+		}
 	}
 }
+
+func recordRefresh(succeeded, failed int) {
+	refreshStatusMutex.Lock()
+	defer refreshStatusMutex.Unlock()
+	now := time.Now()
+	refreshStatus.LastRun = now
+	refreshStatus.Succeeded = succeeded
+	refreshStatus.Failed = failed
+	if succeeded > 0 {
+		refreshStatus.LastSuccess = now
+	}
+}
+
 func safeClose(client cycletls.CycleTLS) {
 	if client.ReqChan != nil {
 		close(client.ReqChan)
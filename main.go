@@ -5,17 +5,29 @@
 package main
 
 import (
+	"context"
+	"errors"
 	"fmt"
+	"net/http"
 	"os"
+	"os/signal"
 	"qodo2api/check"
 	"qodo2api/common"
+	"qodo2api/common/audit"
 	"qodo2api/common/config"
+	"qodo2api/common/lifecycle"
 	logger "qodo2api/common/loggger"
+	"qodo2api/common/proxypool"
+	"qodo2api/common/state"
+	"qodo2api/common/tracing"
+	"qodo2api/cycletls"
 	"qodo2api/job"
 	"qodo2api/middleware"
 	"qodo2api/model"
 	"qodo2api/router"
 	"strconv"
+	"syscall"
+	"time"
 
 	"github.com/gin-gonic/gin"
 )
@@ -23,6 +35,7 @@ import (
 //var buildFS embed.FS
 
 func main() {
+	logger.LogDir = *common.LogDir
 	logger.SetupLogger()
 	logger.SysLog(fmt.Sprintf("qodo2api %s starting...", common.Version))
 
@@ -35,6 +48,53 @@ func main() {
 	var err error
 
 	model.InitTokenEncoders()
+	err = config.InitStateBackend()
+	if err != nil {
+		logger.FatalLog(err)
+	}
+	err = audit.Init(audit.Config{
+		Path:           config.AuditLogPath,
+		IncludeBodies:  config.AuditLogBodies,
+		RedactPatterns: config.AuditRedactPatterns,
+		MaxSize:        int64(config.AuditLogMaxSize) * 1024 * 1024,
+		MaxBackups:     config.AuditLogMaxBackups,
+		MaxAge:         time.Duration(config.AuditLogMaxAge) * 24 * time.Hour,
+	})
+	if err != nil {
+		logger.FatalLog(err)
+	}
+	shutdownTracing, err := tracing.Init(context.Background(), tracing.Config{
+		Exporter:    config.OtelTracesExporter,
+		ServiceName: config.OtelServiceName,
+		SampleRatio: config.OtelTracesSampleRatio,
+		Version:     common.Version,
+	})
+	if err != nil {
+		logger.FatalLog(err)
+	}
+	cycletls.SetPoolOptions(cycletls.PoolOptions{
+		MaxIdleConnsPerHost: config.TLSPoolMaxIdleConnsPerHost,
+		IdleConnTimeout:     time.Duration(config.TLSPoolIdleTimeout) * time.Second,
+		MaxTransports:       config.TLSPoolMaxTransports,
+	})
+	err = proxypool.Init(proxypool.Config{
+		Proxies:       config.ProxyUrls,
+		Bindings:      config.ProxyBindings,
+		ProbeAddr:     config.QodoBaseAddr(),
+		ProbeInterval: time.Duration(config.ProxyHealthCheckInterval) * time.Second,
+		ProbeTimeout:  time.Duration(config.ProxyHealthCheckTimeout) * time.Second,
+		MaxFailures:   config.ProxyMaxFailures,
+		OnHealthChange: func(proxy string, healthy bool, err error) {
+			if healthy {
+				logger.SysLog(fmt.Sprintf("proxy %s recovered", proxy))
+				return
+			}
+			logger.SysError(fmt.Sprintf("proxy %s ejected: %v", proxy, err))
+		},
+	})
+	if err != nil {
+		logger.FatalLog(err)
+	}
 	_, err = config.InitQDCookies()
 	if err != nil {
 		logger.FatalLog(err)
@@ -43,6 +103,8 @@ func main() {
 	server := gin.New()
 	server.Use(gin.Recovery())
 	server.Use(middleware.RequestId())
+	server.Use(middleware.Tracing())
+	server.Use(middleware.InFlight())
 	middleware.SetUpLogger(server)
 
 	// 设置API路由
@@ -59,12 +121,75 @@ func main() {
 		logger.SysLog("running in DEBUG mode.")
 	}
 
+	srv := &http.Server{Addr: ":" + port, Handler: server}
+	serveErr := make(chan error, 1)
+	go func() {
+		serveErr <- srv.ListenAndServe()
+	}()
+
+	jobCtx, stopJob := context.WithCancel(context.Background())
+	jobDone := make(chan struct{})
+	go func() {
+		defer close(jobDone)
+		job.UpdateCookieTokenTask(jobCtx)
+	}()
+
+	lifecycle.SetReady(true)
 	logger.SysLog("qodo2api start success. enjoy it! ^_^\n")
-	go job.UpdateCookieTokenTask()
 
-	err = server.Run(":" + port)
+	quit := make(chan os.Signal, 1)
+	signal.Notify(quit, syscall.SIGINT, syscall.SIGTERM)
+	select {
+	case sig := <-quit:
+		logger.SysLog(fmt.Sprintf("received signal %s, shutting down...", sig))
+	case err = <-serveErr:
+		if !errors.Is(err, http.ErrServerClosed) {
+			logger.FatalLog("failed to start HTTP server: " + err.Error())
+		}
+	}
+	signal.Stop(quit)
 
-	if err != nil {
-		logger.FatalLog("failed to start HTTP server: " + err.Error())
+	shutdown(srv, stopJob, jobDone, shutdownTracing)
+	logger.SysLog("qodo2api stopped.")
+}
+
+// shutdown 依次标记未就绪、停止接收新请求并等待进行中的流式响应结束、停止定时任务,最后刷新审计日志、状态后端及追踪数据
+func shutdown(srv *http.Server, stopJob context.CancelFunc, jobDone <-chan struct{}, shutdownTracing func(context.Context) error) {
+	lifecycle.SetReady(false)
+	if config.ShutdownDelay > 0 {
+		time.Sleep(time.Duration(config.ShutdownDelay) * time.Second)
+	}
+
+	grace := time.Duration(config.ShutdownGracePeriod) * time.Second
+	ctx, cancel := context.WithTimeout(context.Background(), grace)
+	defer cancel()
+
+	// 定时任务与请求排空并行停止,正在进行的一轮刷新不会被打断
+	stopJob()
+
+	logger.SysLog(fmt.Sprintf("waiting up to %s for %d in-flight requests", grace, lifecycle.InFlight()))
+	if err := srv.Shutdown(ctx); err != nil {
+		logger.SysError(fmt.Sprintf("grace period exceeded, closing %d in-flight requests: %v", lifecycle.InFlight(), err))
+		_ = srv.Close()
+	}
+
+	select {
+	case <-jobDone:
+	case <-ctx.Done():
+		logger.SysError("cookie token refresh job did not stop within grace period")
+	}
+	proxypool.Close()
+	cycletls.CloseIdleConnections()
+
+	flushCtx, flushCancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer flushCancel()
+	if err := audit.Close(); err != nil {
+		logger.SysError(fmt.Sprintf("close audit log err: %v", err))
+	}
+	if err := state.Default().Close(); err != nil {
+		logger.SysError(fmt.Sprintf("close state backend err: %v", err))
+	}
+	if err := shutdownTracing(flushCtx); err != nil {
+		logger.SysError(fmt.Sprintf("flush traces err: %v", err))
 	}
 }
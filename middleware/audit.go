@@ -0,0 +1,45 @@
+package middleware
+
+import (
+	"fmt"
+	"github.com/gin-gonic/gin"
+	"qodo2api/common"
+	"qodo2api/common/audit"
+	"qodo2api/common/helper"
+	logger "qodo2api/common/loggger"
+	"strings"
+	"time"
+)
+
+// Audit 为路径以 pathPrefix 开头的请求写入一条审计记录,模型、账号、token数等由后续处理填充到上下文中的记录。
+// 需挂载在IP黑名单及限流之前,被其拒绝的请求同样记录错误类别
+func Audit(pathPrefix string) func(c *gin.Context) {
+	return func(c *gin.Context) {
+		if !audit.Enabled() || !strings.HasPrefix(c.Request.URL.Path, pathPrefix) {
+			c.Next()
+			return
+		}
+
+		start := time.Now()
+		record := &audit.Record{
+			Time:      start,
+			RequestID: c.GetString(helper.RequestIdKey),
+		}
+		c.Set(helper.AuditRecordKey, record)
+
+		c.Next()
+
+		if secret := strings.Replace(c.Request.Header.Get("Authorization"), "Bearer ", "", 1); secret != "" {
+			record.ApiKeyHash = common.StringToSHA256(secret)[:16]
+		}
+		record.LatencyMs = time.Since(start).Milliseconds()
+		record.StatusCode = c.Writer.Status()
+		record.ErrorClass = c.GetString(helper.ErrorClassKey)
+		if record.ErrorClass == "" && record.StatusCode >= 400 {
+			record.ErrorClass = fmt.Sprintf("http_%d", record.StatusCode)
+		}
+		if err := audit.Write(record); err != nil {
+			logger.Errorf(c.Request.Context(), "audit.Write err: %v", err)
+		}
+	}
+}
@@ -0,0 +1,68 @@
+package middleware
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"qodo2api/common/audit"
+	"qodo2api/common/config"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+func TestAuditRecordsRejectedRequests(t *testing.T) {
+	oldBlackList, oldNum, oldBurst := config.IpBlackList, config.RequestRateLimitNum, config.RequestRateLimitBurst
+	defer func() {
+		config.IpBlackList, config.RequestRateLimitNum, config.RequestRateLimitBurst = oldBlackList, oldNum, oldBurst
+	}()
+	config.IpBlackList = []string{"10.0.0.9"}
+	config.RequestRateLimitNum, config.RequestRateLimitBurst = 1, 1
+
+	path := filepath.Join(t.TempDir(), "audit.jsonl")
+	if err := audit.Init(audit.Config{Path: path}); err != nil {
+		t.Fatal(err)
+	}
+
+	gin.SetMode(gin.TestMode)
+	router := gin.New()
+	router.Use(Audit("/v1/"))
+	router.Use(IPBlacklistMiddleware())
+	router.Use(RequestRateLimit())
+	router.GET("/v1/models", func(c *gin.Context) { c.Status(http.StatusOK) })
+	router.GET("/other", func(c *gin.Context) { c.Status(http.StatusOK) })
+
+	for _, req := range []struct{ path, remoteAddr string }{
+		{"/v1/models", "10.0.0.9:1234"},
+		{"/v1/models", "10.0.0.2:1234"},
+		{"/v1/models", "10.0.0.2:1234"},
+		{"/other", "10.0.0.3:1234"},
+	} {
+		r := httptest.NewRequest(http.MethodGet, req.path, nil)
+		r.RemoteAddr = req.remoteAddr
+		router.ServeHTTP(httptest.NewRecorder(), r)
+	}
+	if err := audit.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	for _, line := range strings.Split(strings.TrimSpace(string(data)), "\n") {
+		var record audit.Record
+		if err := json.Unmarshal([]byte(line), &record); err != nil {
+			t.Fatal(err)
+		}
+		got = append(got, record.ErrorClass)
+	}
+	want := []string{"ip_blocked", "", "rate_limit_exceeded"}
+	if strings.Join(got, ",") != strings.Join(want, ",") {
+		t.Errorf("error classes = %q, want %q", got, want)
+	}
+}
@@ -5,18 +5,21 @@ import (
 	"github.com/samber/lo"
 	"net/http"
 	"qodo2api/common"
+	"qodo2api/common/apierror"
 	"qodo2api/common/config"
+	"qodo2api/common/helper"
 	logger "qodo2api/common/loggger"
-	"qodo2api/model"
 	"strings"
 )
 
 func isValidSecret(secret string) bool {
-	if config.ApiSecret == "" {
+	if config.ApiSecret == "" && len(config.ApiKeyPolicies) == 0 {
 		return true
-	} else {
-		return lo.Contains(config.ApiSecrets, secret)
 	}
+	if _, ok := config.GetApiKeyPolicy(secret); ok {
+		return true
+	}
+	return config.ApiSecret != "" && lo.Contains(config.ApiSecrets, secret)
 }
 
 func isValidBackendSecret(secret string) bool {
@@ -30,14 +33,7 @@ func authHelperForOpenai(c *gin.Context) {
 	b := isValidSecret(secret)
 
 	if !b {
-		c.JSON(http.StatusUnauthorized, model.OpenAIErrorResponse{
-			OpenAIError: model.OpenAIError{
-				Message: "API-KEY校验失败",
-				Type:    "invalid_request_error",
-				Code:    "invalid_authorization",
-			},
-		})
-		c.Abort()
+		abortWithOpenAIError(c, http.StatusUnauthorized, "API-KEY校验失败", apierror.TypeInvalidRequest, "invalid_authorization")
 		return
 	}
 
@@ -45,17 +41,43 @@ func authHelperForOpenai(c *gin.Context) {
 	//	c.Request.Header.Set("Authorization", "")
 	//}
 
+	c.Set(helper.ApiKeyKey, secret)
+	if policy, ok := config.GetApiKeyPolicy(secret); ok {
+		if policy.Expired() {
+			abortWithOpenAIError(c, http.StatusForbidden, "API-KEY已过期", apierror.TypeInvalidRequest, "api_key_expired")
+			return
+		}
+		if policy.RequestsPerMinute > 0 {
+			result := requestRateLimiter.Take("API_KEY_RATE_LIMIT"+common.StringToSHA256(secret), 1, policy.RequestsPerMinute, policy.RequestsPerMinute)
+			if !result.Allowed {
+				setRateLimitHeaders(c, "requests", result)
+				abortWithOpenAIError(c, http.StatusTooManyRequests, "API-KEY请求过于频繁,请稍后再试", apierror.TypeRequests, "rate_limit_exceeded")
+				return
+			}
+		}
+		if policy.DailyTokenQuota > 0 && config.GetApiKeyTokenUsage(secret) >= policy.DailyTokenQuota {
+			abortWithOpenAIError(c, http.StatusTooManyRequests, "API-KEY今日token额度已用尽", apierror.TypeQuota, "insufficient_quota")
+			return
+		}
+		c.Set(helper.ApiKeyPolicyKey, policy)
+	}
+
 	c.Next()
 	return
 }
 
+func abortWithOpenAIError(c *gin.Context, status int, message, errType, code string) {
+	c.Set(helper.ErrorClassKey, code)
+	apierror.Abort(c, apierror.New(status, errType, code, message))
+}
+
 func authHelperForBackend(c *gin.Context) {
 	secret := c.Request.Header.Get("Authorization")
 	secret = strings.Replace(secret, "Bearer ", "", 1)
 	if isValidBackendSecret(secret) {
-		logger.Debugf(c.Request.Context(), "BackendSecret is not empty, but not equal to %s", secret)
-		common.SendResponse(c, http.StatusUnauthorized, 1, "unauthorized", "")
-		c.Abort()
+		// 不记录客户端传入的值,未登记的错误密钥无法被脱敏
+		logger.Debug(c.Request.Context(), "BackendSecret is not empty, but the provided secret does not match")
+		abortWithOpenAIError(c, http.StatusUnauthorized, "unauthorized", apierror.TypeInvalidRequest, "invalid_authorization")
 		return
 	}
 
@@ -0,0 +1,15 @@
+package middleware
+
+import (
+	"github.com/gin-gonic/gin"
+	"qodo2api/common/lifecycle"
+)
+
+// InFlight 统计进行中的请求,用于关闭时等待流式响应结束
+func InFlight() func(c *gin.Context) {
+	return func(c *gin.Context) {
+		lifecycle.RequestStarted()
+		defer lifecycle.RequestFinished()
+		c.Next()
+	}
+}
@@ -3,6 +3,7 @@ package middleware
 import (
 	"github.com/gin-gonic/gin"
 	"net/http"
+	"qodo2api/common/apierror"
 	"qodo2api/common/config"
 	"strings"
 )
@@ -17,7 +18,7 @@ func IPBlacklistMiddleware() gin.HandlerFunc {
 		for _, blockedIP := range config.IpBlackList {
 			if strings.TrimSpace(blockedIP) == clientIP {
 				// 如果在黑名单中，返回403 Forbidden
-				c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"error": "Forbidden"})
+				abortWithOpenAIError(c, http.StatusForbidden, "Forbidden", apierror.TypePermission, "ip_blocked")
 				return
 			}
 		}
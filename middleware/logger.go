@@ -1,25 +1,23 @@
 package middleware
 
 import (
-	"fmt"
 	"github.com/gin-gonic/gin"
-	"qodo2api/common/helper"
+	"log/slog"
+	logger "qodo2api/common/loggger"
+	"time"
 )
 
+// SetUpLogger 以结构化日志记录每个请求的访问日志
 func SetUpLogger(server *gin.Engine) {
-	server.Use(gin.LoggerWithFormatter(func(param gin.LogFormatterParams) string {
-		var requestID string
-		if param.Keys != nil {
-			requestID = param.Keys[helper.RequestIdKey].(string)
-		}
-		return fmt.Sprintf("[GIN] %s | %s | %3d | %13v | %15s | %7s %s\n",
-			param.TimeStamp.Format("2006/01/02 - 15:04:05"),
-			requestID,
-			param.StatusCode,
-			param.Latency,
-			param.ClientIP,
-			param.Method,
-			param.Path,
+	server.Use(func(c *gin.Context) {
+		start := time.Now()
+		c.Next()
+		logger.Logger().LogAttrs(c.Request.Context(), slog.LevelInfo, "request completed",
+			slog.Int("status", c.Writer.Status()),
+			slog.Duration("latency", time.Since(start)),
+			slog.String("client_ip", c.ClientIP()),
+			slog.String("method", c.Request.Method),
+			slog.String("path", c.Request.URL.Path),
 		)
-	}))
+	})
 }
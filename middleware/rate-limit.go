@@ -1,36 +1,196 @@
 package middleware
 
 import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
 	"github.com/gin-gonic/gin"
+	"io"
+	"math"
 	"net/http"
 	"qodo2api/common"
+	"qodo2api/common/apierror"
 	"qodo2api/common/config"
+	"qodo2api/model"
+	"strconv"
+	"strings"
+	"time"
 )
 
-var timeFormat = "2006-01-02T15:04:05.000Z"
+const (
+	tokenRateLimitKey = "TokenRateLimitKey"
+	requestBodyKey    = "RequestBodyKey"
+)
+
+var requestRateLimiter common.TokenBucketLimiter
+var tokenRateLimiter common.TokenBucketLimiter
+
+// rateLimitKey 按 RATE_LIMIT_KEY_BY 生成限流key。
+// 限流先于鉴权执行,仅在请求携带已配置的API-KEY时按KEY或user计数,否则退化为客户端IP,避免伪造KEY或user绕过限流。
+// 按 user 计数时读取请求体失败返回错误
+func rateLimitKey(c *gin.Context) (string, error) {
+	if config.RateLimitKeyBy != "user" && config.RateLimitKeyBy != "api_key" {
+		return "ip:" + c.ClientIP(), nil
+	}
+	secret := strings.Replace(c.Request.Header.Get("Authorization"), "Bearer ", "", 1)
+	if !isConfiguredSecret(secret) {
+		return "ip:" + c.ClientIP(), nil
+	}
+	key := "key:" + common.StringToSHA256(secret)
+	if config.RateLimitKeyBy == "user" {
+		user, err := peekRequestUser(c)
+		if err != nil {
+			return "", err
+		}
+		if user != "" {
+			return key + ":user:" + user, nil
+		}
+	}
+	return key, nil
+}
+
+// isConfiguredSecret 是否为已配置的API-KEY,未配置任何KEY时所有请求均可通过鉴权,不能作为限流维度
+func isConfiguredSecret(secret string) bool {
+	if secret == "" || (config.ApiSecret == "" && len(config.ApiKeyPolicies) == 0) {
+		return false
+	}
+	return isValidSecret(secret)
+}
 
-var inMemoryRateLimiter common.InMemoryRateLimiter
+// peekRequestUser 读取请求体中的 user 字段,并还原请求体供后续处理
+func peekRequestUser(c *gin.Context) (string, error) {
+	body, err := peekRequestBody(c)
+	if err != nil {
+		return "", err
+	}
+	var req struct {
+		User string `json:"user"`
+	}
+	if len(body) == 0 || json.Unmarshal(body, &req) != nil {
+		return "", nil
+	}
+	return req.User, nil
+}
 
-func memoryRateLimiter(c *gin.Context, maxRequestNum int, duration int64, mark string) {
-	key := mark + c.ClientIP()
-	if !inMemoryRateLimiter.Request(key, maxRequestNum, duration) {
-		c.JSON(http.StatusTooManyRequests, gin.H{
-			"success": false,
-			"message": "请求过于频繁,请稍后再试",
-		})
-		c.Abort()
+// peekedBody 已读取的请求体或读取失败的错误
+type peekedBody struct {
+	body []byte
+	err  error
+}
+
+// peekRequestBody 读取请求体并还原,超过 MAX_REQUEST_BODY_SIZE 时返回错误。
+// 只读取一次,结果(包括错误)缓存在请求上下文中,失败后请求体已不完整,之后的调用返回同一错误
+func peekRequestBody(c *gin.Context) ([]byte, error) {
+	if value, ok := c.Get(requestBodyKey); ok {
+		peeked := value.(peekedBody)
+		return peeked.body, peeked.err
+	}
+	if c.Request.Body == nil {
+		return nil, nil
+	}
+	reader := c.Request.Body
+	if config.MaxRequestBodySize > 0 {
+		reader = http.MaxBytesReader(c.Writer, c.Request.Body, config.MaxRequestBodySize)
+	}
+	body, err := io.ReadAll(reader)
+	if err != nil {
+		c.Set(requestBodyKey, peekedBody{err: err})
+		return nil, err
+	}
+	c.Request.Body = io.NopCloser(bytes.NewReader(body))
+	c.Set(requestBodyKey, peekedBody{body: body})
+	return body, nil
+}
+
+// abortRequestBodyError 读取请求体失败时中止请求
+func abortRequestBodyError(c *gin.Context, err error) {
+	var maxBytesErr *http.MaxBytesError
+	if errors.As(err, &maxBytesErr) {
+		abortWithOpenAIError(c, http.StatusRequestEntityTooLarge, fmt.Sprintf("Request body exceeds %d bytes", maxBytesErr.Limit), apierror.TypeInvalidRequest, "request_too_large")
 		return
 	}
+	abortWithOpenAIError(c, http.StatusBadRequest, "Failed to read request body", apierror.TypeInvalidRequest, "invalid_request")
 }
 
-func rateLimitFactory(maxRequestNum int, duration int64, mark string) func(c *gin.Context) {
-	// It's safe to call multi times.
-	inMemoryRateLimiter.Init(config.RateLimitKeyExpirationDuration)
-	return func(c *gin.Context) {
-		memoryRateLimiter(c, maxRequestNum, duration, mark)
+func setRateLimitHeaders(c *gin.Context, kind string, result common.TokenBucketResult) {
+	c.Header("x-ratelimit-limit-"+kind, strconv.Itoa(result.Limit))
+	c.Header("x-ratelimit-remaining-"+kind, strconv.Itoa(result.Remaining))
+	c.Header("x-ratelimit-reset-"+kind, result.Reset.Round(100*time.Millisecond).String())
+	if !result.Allowed {
+		c.Header("Retry-After", strconv.Itoa(int(math.Ceil(result.RetryAfter.Seconds()))))
 	}
 }
 
 func RequestRateLimit() func(c *gin.Context) {
-	return rateLimitFactory(config.RequestRateLimitNum, config.RequestRateLimitDuration, "REQUEST_RATE_LIMIT")
+	return func(c *gin.Context) {
+		if config.RequestRateLimitNum <= 0 {
+			c.Next()
+			return
+		}
+		key, err := rateLimitKey(c)
+		if err != nil {
+			abortRequestBodyError(c, err)
+			return
+		}
+		result := requestRateLimiter.Take("REQUEST_RATE_LIMIT"+key, 1, config.RequestRateLimitNum, config.RequestRateLimitBurst)
+		setRateLimitHeaders(c, "requests", result)
+		if !result.Allowed {
+			abortWithOpenAIError(c, http.StatusTooManyRequests, "请求过于频繁,请稍后再试", apierror.TypeRequests, "rate_limit_exceeded")
+			return
+		}
+		c.Next()
+	}
+}
+
+// TokenRateLimit 按每分钟token数限流,请求前预扣提示词token,生成的token由 ConsumeTokenRateLimit 事后补扣
+func TokenRateLimit() func(c *gin.Context) {
+	return func(c *gin.Context) {
+		if config.TokenRateLimitNum <= 0 {
+			c.Next()
+			return
+		}
+		var req model.OpenAIChatCompletionRequest
+		body, err := peekRequestBody(c)
+		if err != nil {
+			abortRequestBodyError(c, err)
+			return
+		}
+		_ = json.Unmarshal(body, &req)
+		promptTokens := model.CountTokenText(string(body), req.Model)
+
+		// 超过突发量的请求永远无法取到足够的令牌,直接拒绝而不是一直返回429
+		burst := config.TokenRateLimitBurst
+		if burst <= 0 {
+			burst = config.TokenRateLimitNum
+		}
+		if promptTokens > burst {
+			abortWithOpenAIError(c, http.StatusBadRequest, fmt.Sprintf("Request exceeds token limit, requested %d, limit %d", promptTokens, burst), apierror.TypeInvalidRequest, "token_limit_exceeded")
+			return
+		}
+
+		limitKey, err := rateLimitKey(c)
+		if err != nil {
+			abortRequestBodyError(c, err)
+			return
+		}
+		key := "TOKEN_RATE_LIMIT" + limitKey
+		result := tokenRateLimiter.Take(key, promptTokens, config.TokenRateLimitNum, config.TokenRateLimitBurst)
+		setRateLimitHeaders(c, "tokens", result)
+		if !result.Allowed {
+			abortWithOpenAIError(c, http.StatusTooManyRequests, fmt.Sprintf("Rate limit reached for tokens per minute, requested %d", promptTokens), apierror.TypeTokens, "rate_limit_exceeded")
+			return
+		}
+		c.Set(tokenRateLimitKey, key)
+		c.Next()
+	}
+}
+
+// ConsumeTokenRateLimit 补扣本次请求生成的token数
+func ConsumeTokenRateLimit(c *gin.Context, completionTokens int) {
+	key := c.GetString(tokenRateLimitKey)
+	if key == "" || config.TokenRateLimitNum <= 0 {
+		return
+	}
+	tokenRateLimiter.Consume(key, completionTokens, config.TokenRateLimitNum, config.TokenRateLimitBurst)
 }
@@ -0,0 +1,120 @@
+package middleware
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"qodo2api/common"
+	"qodo2api/common/config"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+func newTestContext(authorization, body string) (*gin.Context, *httptest.ResponseRecorder) {
+	gin.SetMode(gin.TestMode)
+	w := httptest.NewRecorder()
+	c, _ := gin.CreateTestContext(w)
+	c.Request = httptest.NewRequest(http.MethodPost, "/v1/chat/completions", strings.NewReader(body))
+	c.Request.RemoteAddr = "10.0.0.1:1234"
+	if authorization != "" {
+		c.Request.Header.Set("Authorization", authorization)
+	}
+	return c, w
+}
+
+func TestRateLimitKey(t *testing.T) {
+	oldKeyBy, oldSecret, oldSecrets := config.RateLimitKeyBy, config.ApiSecret, config.ApiSecrets
+	defer func() {
+		config.RateLimitKeyBy, config.ApiSecret, config.ApiSecrets = oldKeyBy, oldSecret, oldSecrets
+	}()
+
+	validKey := "key:" + common.StringToSHA256("sk-valid")
+	tests := []struct {
+		name          string
+		keyBy         string
+		secret        string // 已配置的API_SECRET
+		authorization string
+		body          string
+		want          string
+	}{
+		{name: "ip", keyBy: "ip", secret: "sk-valid", authorization: "Bearer sk-valid", want: "ip:10.0.0.1"},
+		{name: "valid key", keyBy: "api_key", secret: "sk-valid", authorization: "Bearer sk-valid", want: validKey},
+		{name: "forged key falls back to ip", keyBy: "api_key", secret: "sk-valid", authorization: "Bearer sk-random", want: "ip:10.0.0.1"},
+		{name: "no secrets configured falls back to ip", keyBy: "api_key", authorization: "Bearer sk-anything", want: "ip:10.0.0.1"},
+		{name: "missing key falls back to ip", keyBy: "api_key", secret: "sk-valid", want: "ip:10.0.0.1"},
+		{name: "user of valid key", keyBy: "user", secret: "sk-valid", authorization: "Bearer sk-valid", body: `{"user":"u1"}`, want: validKey + ":user:u1"},
+		{name: "valid key without user", keyBy: "user", secret: "sk-valid", authorization: "Bearer sk-valid", body: `{}`, want: validKey},
+		{name: "user with forged key falls back to ip", keyBy: "user", secret: "sk-valid", authorization: "Bearer sk-random", body: `{"user":"u1"}`, want: "ip:10.0.0.1"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			config.RateLimitKeyBy = tt.keyBy
+			config.ApiSecret, config.ApiSecrets = tt.secret, strings.Split(tt.secret, ",")
+			c, _ := newTestContext(tt.authorization, tt.body)
+			if got, err := rateLimitKey(c); err != nil || got != tt.want {
+				t.Errorf("rateLimitKey = %q, %v, want %q", got, err, tt.want)
+			}
+		})
+	}
+}
+
+func TestPeekRequestBody(t *testing.T) {
+	oldSize := config.MaxRequestBodySize
+	defer func() { config.MaxRequestBodySize = oldSize }()
+	config.MaxRequestBodySize = 8
+
+	c, _ := newTestContext("", "12345678")
+	body, err := peekRequestBody(c)
+	if err != nil || string(body) != "12345678" {
+		t.Fatalf("peekRequestBody = %q, %v", body, err)
+	}
+	// 请求体已还原,后续处理仍可读取
+	if again, err := peekRequestBody(c); err != nil || string(again) != "12345678" {
+		t.Fatalf("second peekRequestBody = %q, %v", again, err)
+	}
+
+	c, _ = newTestContext("", "123456789")
+	if _, err := peekRequestBody(c); err == nil {
+		t.Fatal("body over the limit should fail")
+	}
+}
+
+func TestTokenRateLimitRejectsLargeBody(t *testing.T) {
+	oldSize, oldNum := config.MaxRequestBodySize, config.TokenRateLimitNum
+	defer func() { config.MaxRequestBodySize, config.TokenRateLimitNum = oldSize, oldNum }()
+	config.MaxRequestBodySize, config.TokenRateLimitNum = 16, 1000
+
+	c, w := newTestContext("", `{"model":"gpt-4o","messages":[]}`)
+	TokenRateLimit()(c)
+	if !c.IsAborted() || w.Code != http.StatusRequestEntityTooLarge {
+		t.Fatalf("status = %d, aborted = %v", w.Code, c.IsAborted())
+	}
+	if !strings.Contains(w.Body.String(), `"code":"request_too_large"`) {
+		t.Errorf("body = %s", w.Body.String())
+	}
+}
+
+func TestRequestRateLimitRejectsLargeBodyKeyedByUser(t *testing.T) {
+	oldKeyBy, oldSecret, oldSecrets := config.RateLimitKeyBy, config.ApiSecret, config.ApiSecrets
+	oldSize, oldRequestNum, oldTokenNum := config.MaxRequestBodySize, config.RequestRateLimitNum, config.TokenRateLimitNum
+	defer func() {
+		config.RateLimitKeyBy, config.ApiSecret, config.ApiSecrets = oldKeyBy, oldSecret, oldSecrets
+		config.MaxRequestBodySize, config.RequestRateLimitNum, config.TokenRateLimitNum = oldSize, oldRequestNum, oldTokenNum
+	}()
+	config.RateLimitKeyBy, config.ApiSecret, config.ApiSecrets = "user", "sk-valid", []string{"sk-valid"}
+	config.MaxRequestBodySize, config.RequestRateLimitNum, config.TokenRateLimitNum = 16, 100, 1000
+
+	c, w := newTestContext("Bearer sk-valid", `{"user":"u1","model":"gpt-4o","messages":[]}`)
+	RequestRateLimit()(c)
+	if !c.IsAborted() || w.Code != http.StatusRequestEntityTooLarge {
+		t.Fatalf("status = %d, aborted = %v", w.Code, c.IsAborted())
+	}
+	if !strings.Contains(w.Body.String(), `"code":"request_too_large"`) {
+		t.Errorf("body = %s", w.Body.String())
+	}
+	// 失败结果已缓存,后续读取不会拿到残缺的请求体
+	if _, err := peekRequestBody(c); err == nil {
+		t.Error("cached peekRequestBody should return the read error")
+	}
+}
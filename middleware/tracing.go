@@ -0,0 +1,40 @@
+package middleware
+
+import (
+	"fmt"
+	"github.com/gin-gonic/gin"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	"qodo2api/common/helper"
+	"qodo2api/common/tracing"
+)
+
+// Tracing 为每个请求开启服务端span,并继承请求头中 traceparent 所属的链路
+func Tracing() func(c *gin.Context) {
+	return func(c *gin.Context) {
+		ctx := tracing.Extract(c.Request.Context(), propagation.HeaderCarrier(c.Request.Header))
+		route := c.FullPath()
+		if route == "" {
+			route = c.Request.URL.Path
+		}
+		ctx, span := tracing.StartServer(ctx, fmt.Sprintf("%s %s", c.Request.Method, route),
+			attribute.String("http.request.method", c.Request.Method),
+			attribute.String("http.route", route),
+			attribute.String("request_id", c.GetString(helper.RequestIdKey)),
+		)
+		c.Request = c.Request.WithContext(ctx)
+
+		c.Next()
+
+		status := c.Writer.Status()
+		span.SetAttributes(attribute.Int("http.response.status_code", status))
+		if class := c.GetString(helper.ErrorClassKey); class != "" {
+			span.SetAttributes(tracing.AttrErrorClass.String(class))
+		}
+		if status >= 500 {
+			span.SetStatus(codes.Error, fmt.Sprintf("HTTP %d", status))
+		}
+		span.End()
+	}
+}
@@ -0,0 +1,231 @@
+package mock_server
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// 脚本步骤,每次聊天请求按顺序消费一个步骤,步骤用完后返回正常回复
+const (
+	StepOK             = "ok"
+	StepRateLimit      = "rate_limit"
+	StepInvalidToken   = "invalid_token"
+	StepUsageExhausted = "usage_exhausted"
+	StepUnavailable    = "503"
+)
+
+// 各步骤对应的上游响应,与 upstreamerr 的内置分类规则保持一致
+const (
+	rateLimitBody      = `{"error":"Too many concurrent requests","message":"You have reached your maximum concurrent request limit. Please try again later."}`
+	invalidTokenBody   = `{"error":"Invalid token"}`
+	usageExhaustedBody = `{"error":"Usage limit exceeded","message":"You have reached your Kilo Code usage limit. Please upgrade your plan."}`
+	unavailableBody    = `{"error":"Service Unavailable","message":"The service is temporarily unavailable. Please try again later."}`
+)
+
+const accessTokenPrefix = "mock-access-"
+
+// Scenario 脚本化的上游行为
+type Scenario struct {
+	// Steps 未单独配置的账号共用的步骤序列
+	Steps []string `json:"steps"`
+	// Accounts 按 refresh token 配置的步骤序列,用于模拟部分账号被限速或失效
+	Accounts map[string][]string `json:"accounts"`
+	// InvalidRefreshTokens 刷新时返回 INVALID_REFRESH_TOKEN 的 refresh token
+	InvalidRefreshTokens []string `json:"invalid_refresh_tokens"`
+	// Reply 正常回复的内容,按空格拆分为多个SSE事件输出
+	Reply string `json:"reply"`
+	// ChunkDelayMs 正常回复中每个SSE事件的间隔
+	ChunkDelayMs int `json:"chunk_delay_ms"`
+}
+
+// ParseScenario 解析JSON格式的场景
+func ParseScenario(data string) (Scenario, error) {
+	var scenario Scenario
+	if strings.TrimSpace(data) == "" {
+		return scenario, nil
+	}
+	if err := json.Unmarshal([]byte(data), &scenario); err != nil {
+		return scenario, fmt.Errorf("invalid mock scenario: %v", err)
+	}
+	return scenario, nil
+}
+
+// Stats 各接口的调用计数
+type Stats struct {
+	TokenRefreshes int            `json:"token_refreshes"`
+	ChatRequests   int            `json:"chat_requests"`
+	Steps          map[string]int `json:"steps"`
+	Accounts       map[string]int `json:"accounts"`
+}
+
+// Server 模拟Qodo聊天接口及Firebase token刷新接口的服务
+type Server struct {
+	mutex    sync.Mutex
+	scenario Scenario
+	cursor   map[string]int
+	stats    Stats
+}
+
+func NewServer(scenario Scenario) *Server {
+	s := &Server{}
+	s.SetScenario(scenario)
+	return s
+}
+
+// SetScenario 替换当前场景并重置步骤进度及计数
+func (s *Server) SetScenario(scenario Scenario) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if scenario.Reply == "" {
+		scenario.Reply = "Hello from the mock Qodo server."
+	}
+	s.scenario = scenario
+	s.cursor = make(map[string]int)
+	s.stats = Stats{Steps: make(map[string]int), Accounts: make(map[string]int)}
+}
+
+// GetStats 返回当前计数的副本
+func (s *Server) GetStats() Stats {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	stats := Stats{
+		TokenRefreshes: s.stats.TokenRefreshes,
+		ChatRequests:   s.stats.ChatRequests,
+		Steps:          make(map[string]int, len(s.stats.Steps)),
+		Accounts:       make(map[string]int, len(s.stats.Accounts)),
+	}
+	for k, v := range s.stats.Steps {
+		stats.Steps[k] = v
+	}
+	for k, v := range s.stats.Accounts {
+		stats.Accounts[k] = v
+	}
+	return stats
+}
+
+// Handler 返回挂载了全部模拟接口的路由
+//
+//	POST /v1/token          Firebase token 刷新(FIREBASE_TOKEN_URL 指向此地址)
+//	POST /v2/chats/chat     Qodo 聊天SSE(QODO_BASE_URL 指向服务根地址)
+//	PUT  /mock/scenario     替换场景
+//	GET  /mock/stats        查看调用计数
+func (s *Server) Handler() http.Handler {
+	gin.SetMode(gin.ReleaseMode)
+	router := gin.New()
+	router.Use(gin.Recovery())
+	router.POST("/v1/token", s.refreshToken)
+	router.POST("/v2/chats/chat", s.chat)
+	router.PUT("/mock/scenario", func(c *gin.Context) {
+		var scenario Scenario
+		if err := c.BindJSON(&scenario); err != nil {
+			return
+		}
+		s.SetScenario(scenario)
+		c.Status(http.StatusNoContent)
+	})
+	router.GET("/mock/stats", func(c *gin.Context) {
+		c.JSON(http.StatusOK, s.GetStats())
+	})
+	return router
+}
+
+func (s *Server) refreshToken(c *gin.Context) {
+	refreshToken := c.PostForm("refresh_token")
+
+	s.mutex.Lock()
+	s.stats.TokenRefreshes++
+	invalid := refreshToken == ""
+	for _, token := range s.scenario.InvalidRefreshTokens {
+		if token == refreshToken {
+			invalid = true
+		}
+	}
+	s.mutex.Unlock()
+
+	if invalid {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": gin.H{"code": 400, "message": "INVALID_REFRESH_TOKEN", "status": "INVALID_ARGUMENT"},
+		})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"access_token":  accessTokenPrefix + refreshToken,
+		"expires_in":    "3600",
+		"token_type":    "Bearer",
+		"refresh_token": refreshToken,
+		"id_token":      accessTokenPrefix + refreshToken,
+		"user_id":       "mock-user",
+		"project_id":    "mock-project",
+	})
+}
+
+// nextStep 取出账号的下一个步骤
+func (s *Server) nextStep(account string) (step string, delay time.Duration, reply string) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	steps, ok := s.scenario.Accounts[account]
+	key := account
+	if !ok {
+		steps, key = s.scenario.Steps, ""
+	}
+	step = StepOK
+	if i := s.cursor[key]; i < len(steps) {
+		step = steps[i]
+		s.cursor[key] = i + 1
+	}
+
+	s.stats.ChatRequests++
+	s.stats.Steps[step]++
+	s.stats.Accounts[account]++
+	return step, time.Duration(s.scenario.ChunkDelayMs) * time.Millisecond, s.scenario.Reply
+}
+
+func (s *Server) chat(c *gin.Context) {
+	authorization := c.GetHeader("Authorization")
+	if !strings.HasPrefix(authorization, "Bearer "+accessTokenPrefix) {
+		c.String(http.StatusUnauthorized, invalidTokenBody)
+		return
+	}
+	account := strings.TrimPrefix(authorization, "Bearer "+accessTokenPrefix)
+
+	step, delay, reply := s.nextStep(account)
+	switch step {
+	case StepRateLimit:
+		c.String(http.StatusTooManyRequests, rateLimitBody)
+		return
+	case StepInvalidToken:
+		c.String(http.StatusUnauthorized, invalidTokenBody)
+		return
+	case StepUsageExhausted:
+		c.String(http.StatusPaymentRequired, usageExhaustedBody)
+		return
+	case StepUnavailable:
+		c.String(http.StatusServiceUnavailable, unavailableBody)
+		return
+	}
+
+	c.Header("Content-Type", "text/plain; charset=utf-8")
+	c.Status(http.StatusOK)
+	for i, word := range strings.Fields(reply) {
+		if i > 0 {
+			word = " " + word
+		}
+		event, _ := json.Marshal(gin.H{"type": "text", "data": gin.H{"content": word}})
+		if _, err := fmt.Fprintf(c.Writer, "%s\n", event); err != nil {
+			return
+		}
+		c.Writer.Flush()
+		if delay > 0 {
+			time.Sleep(delay)
+		}
+	}
+	_, _ = fmt.Fprint(c.Writer, "[DONE]\n")
+	c.Writer.Flush()
+}
@@ -11,6 +11,7 @@ type OpenAIChatCompletionRequest struct {
 	Messages    []OpenAIChatMessage `json:"messages"`
 	MaxTokens   int                 `json:"max_tokens"`
 	Temperature float64             `json:"temperature"`
+	User        string              `json:"user"`
 }
 
 type OpenAIChatMessage struct {
@@ -54,27 +55,6 @@ func (r *OpenAIChatCompletionRequest) AddMessage(message OpenAIChatMessage) {
 	r.Messages = append([]OpenAIChatMessage{message}, r.Messages...)
 }
 
-func (r *OpenAIChatCompletionRequest) PrependMessagesFromJSON(jsonString string) error {
-	var newMessages []OpenAIChatMessage
-	err := json.Unmarshal([]byte(jsonString), &newMessages)
-	if err != nil {
-		return err
-	}
-
-	// 查找最后一个 system role 的索引
-	var insertIndex int
-	for i := len(r.Messages) - 1; i >= 0; i-- {
-		if r.Messages[i].Role == "system" {
-			insertIndex = i + 1
-			break
-		}
-	}
-
-	// 将 newMessages 插入到找到的索引后面
-	r.Messages = append(r.Messages[:insertIndex], append(newMessages, r.Messages[insertIndex:]...)...)
-	return nil
-}
-
 func (r *OpenAIChatCompletionRequest) SystemMessagesProcess(model string) {
 	if r.Messages == nil {
 		return
@@ -1,50 +1,136 @@
 package qodo_api
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"github.com/gin-gonic/gin"
 	"github.com/google/uuid"
+	"net/url"
 	"qodo2api/common/config"
 	logger "qodo2api/common/loggger"
+	"qodo2api/common/metrics"
+	"qodo2api/common/proxypool"
 	"qodo2api/cycletls"
 	"strings"
 )
 
-const (
-	baseURL      = "https://api.gen.qodo.ai"
-	chatEndpoint = baseURL + "/v2/chats/chat"
+const chatPath = "/v2/chats/chat"
+
+// errorEvent 上游以 text/event-stream 返回时表示错误的事件名
+const errorEvent = "error"
+
+var (
+	streamsTotal     = metrics.NewCounter("qodo_upstream_streams_total", "Upstream chat streams started.")
+	streamsCancelled = metrics.NewCounter("qodo_upstream_streams_cancelled_total", "Upstream chat streams aborted because the client disconnected.")
 )
 
+// chatEndpoint 上游聊天接口地址,基础地址由 QODO_BASE_URL 配置
+func chatEndpoint() string {
+	return strings.TrimSuffix(config.QodoBaseUrl, "/") + chatPath
+}
+
+// upstreamHost 基础地址对应的 Host 请求头
+func upstreamHost() string {
+	u, err := url.Parse(config.QodoBaseUrl)
+	if err != nil || u.Host == "" {
+		return "api.gen.qodo.ai"
+	}
+	return u.Host
+}
+
 func MakeStreamChatRequest(c *gin.Context, client cycletls.CycleTLS, jsonData []byte, cookie string) (<-chan cycletls.SSEResponse, error) {
-	split := strings.Split(cookie, "=")
-	tokenInfo, ok := config.QDTokenMap[split[0]]
+	if id := replayId(c); id != "" {
+		fixture, err := LoadFixture(config.SSEReplayDir, id)
+		if err != nil {
+			return nil, fmt.Errorf("Failed to load replay fixture: %v", err)
+		}
+		logger.Infof(c.Request.Context(), "Replaying upstream SSE fixture %s", fixture.ID)
+		return fixture.Replay(c.Request.Context(), config.SSEReplayRealtime), nil
+	}
+
+	tokenInfo, ok := config.GetQDTokenInfo(cookie)
 	if !ok {
-		return nil, fmt.Errorf("cookie not found in QDTokenMap")
+		return nil, fmt.Errorf("token not found for cookie")
 	}
 
+	// 同一账号固定经同一代理出口,避免多个账号共用出口IP而被一并限速
+	proxyUrl := proxypool.Get(cookie)
 	options := cycletls.Options{
 		Timeout: 10 * 60 * 60,
-		Proxy:   config.ProxyUrl, // 在每个请求中设置代理
+		Proxy:   proxyUrl,
 		Body:    string(jsonData),
 		Method:  "POST",
 		Headers: map[string]string{
-			"User-Agent":      "axios/1.7.9",
-			"Connection":      "close",
-			"Host":            "api.gen.qodo.ai",
-			"Accept":          "text/plain",
-			"Accept-Encoding": "gzip, compress, deflate, br",
-			"Content-Type":    "application/json",
-			"Request-id":      uuid.New().String(),
-			"Authorization":   `Bearer ` + tokenInfo.AccessToken,
+			"Host":          upstreamHost(),
+			"Accept":        "text/plain",
+			"Content-Type":  "application/json",
+			"Request-id":    uuid.New().String(),
+			"Authorization": `Bearer ` + tokenInfo.AccessToken,
 		},
 	}
+	// JA3、HTTP/2 设置、请求头顺序及 User-Agent 取自同一指纹,保持一致
+	profile := config.SelectTLSProfile(cookie)
+	profile.Apply(&options)
+	logger.Debugf(c.Request.Context(), "Upstream TLS profile: %s", profile.Name)
 
-	logger.Debug(c.Request.Context(), fmt.Sprintf("cookie: %v", cookie))
-
-	sseChan, err := client.DoSSE(chatEndpoint, options, "POST")
+	// 客户端断开时取消请求上下文,中断上游读取,避免继续消耗账号额度
+	ctx := c.Request.Context()
+	sseChan, err := client.DoSSEContext(ctx, chatEndpoint(), options, "POST")
 	if err != nil {
 		logger.Errorf(c, "Failed to make stream request: %v", err)
-		return nil, fmt.Errorf("Failed to make stream request: %v", err)
+		return nil, fmt.Errorf("Failed to make stream request: %w", err)
+	}
+	sseChan = observeStream(ctx, sseChan, proxyUrl)
+
+	if config.SSERecordDir != "" {
+		recorder := newFixtureRecorder(config.SSERecordDir, nextFixtureId(c), chatEndpoint(), jsonData)
+		sseChan = recorder.Tee(ctx, sseChan, func(path string, err error) {
+			if err != nil {
+				logger.Errorf(ctx, "Failed to save SSE fixture: %v", err)
+				return
+			}
+			logger.Debugf(ctx, "SSE fixture saved: %s", path)
+		})
 	}
 	return sseChan, nil
 }
+
+// observeStream 转发上游事件并统计,未收到结束事件前请求被取消的计为取消的流。
+// 具名事件中 error 视为结束事件,其余事件(含默认的 message)按普通数据转发。
+// 首个事件用于判断经 proxyUrl 的连接是否成功,仅连接失败计为代理失败,连接后的读取错误及上游错误不计
+func observeStream(ctx context.Context, source <-chan cycletls.SSEResponse, proxyUrl string) <-chan cycletls.SSEResponse {
+	streamsTotal.Inc()
+	out := make(chan cycletls.SSEResponse)
+	go func() {
+		defer close(out)
+		done := false
+		first := true
+		for response := range source {
+			if first && proxyUrl != "" {
+				first = false
+				var connectErr *cycletls.ConnectError
+				if errors.As(response.Err, &connectErr) {
+					proxypool.ReportFailure(proxyUrl, response.Err)
+				} else {
+					proxypool.ReportSuccess(proxyUrl)
+				}
+			}
+			if response.Event == errorEvent && !response.Done {
+				// 具名 error 事件按上游错误处理,由调用方按内容分类
+				response.Done = true
+			}
+			done = done || response.Done
+			// 调用方提前返回时不再转发,上游在ctx取消后自行结束
+			select {
+			case out <- response:
+			case <-ctx.Done():
+			}
+		}
+		if !done && ctx.Err() != nil {
+			streamsCancelled.Inc()
+			logger.Info(ctx, "Client disconnected, upstream stream cancelled")
+		}
+	}()
+	return out
+}
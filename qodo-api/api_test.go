@@ -0,0 +1,42 @@
+package qodo_api
+
+import (
+	"context"
+	"errors"
+	"qodo2api/common/proxypool"
+	"qodo2api/cycletls"
+	"testing"
+)
+
+func TestObserveStreamReportsProxy(t *testing.T) {
+	const proxy = "http://127.0.0.1:3128"
+	tests := []struct {
+		name         string
+		first        cycletls.SSEResponse
+		wantFailures int // 上报后的连续失败次数,成功上报清零
+	}{
+		{name: "data", first: cycletls.SSEResponse{Status: 200, Data: `{"type":"text"}`}},
+		{name: "upstream error", first: cycletls.SSEResponse{Status: 503, Data: "unavailable", Done: true}},
+		{name: "read error", first: cycletls.SSEResponse{Data: "read failed", Done: true, Err: errors.New("unexpected EOF")}},
+		{name: "connect error", first: cycletls.SSEResponse{Data: "connect failed", Done: true, Err: &cycletls.ConnectError{Err: errors.New("connection refused")}}, wantFailures: 2},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := proxypool.Init(proxypool.Config{Proxies: []string{proxy}}); err != nil {
+				t.Fatal(err)
+			}
+			defer proxypool.Init(proxypool.Config{})
+			// 先记一次失败,成功上报会将其清零
+			proxypool.ReportFailure(proxy, errors.New("earlier failure"))
+
+			source := make(chan cycletls.SSEResponse, 1)
+			source <- tt.first
+			close(source)
+			for range observeStream(context.Background(), source, proxy) {
+			}
+			if got := proxypool.Stats()[0].ConsecutiveFailures; got != tt.wantFailures {
+				t.Errorf("consecutive failures = %d, want %d", got, tt.wantFailures)
+			}
+		})
+	}
+}
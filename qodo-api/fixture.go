@@ -0,0 +1,209 @@
+package qodo_api
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"github.com/gin-gonic/gin"
+	"os"
+	"path/filepath"
+	"qodo2api/common/config"
+	"qodo2api/common/helper"
+	logger "qodo2api/common/loggger"
+	"qodo2api/cycletls"
+	"regexp"
+	"time"
+)
+
+const (
+	// ReplayIdHeader 回放模式下指定录制文件ID的请求头
+	ReplayIdHeader = "X-Replay-Id"
+	// ReplaySecretHeader 回放时需同时携带的请求头,值为 BACKEND_SECRET
+	ReplaySecretHeader = "X-Replay-Secret"
+)
+
+// replayId 返回请求指定的回放ID,需配置回放目录及 BACKEND_SECRET 且请求携带匹配的 X-Replay-Secret,否则返回空
+func replayId(c *gin.Context) string {
+	id := c.GetHeader(ReplayIdHeader)
+	if id == "" || config.SSEReplayDir == "" {
+		return ""
+	}
+	provided := c.GetHeader(ReplaySecretHeader)
+	if config.BackendSecret == "" || subtle.ConstantTimeCompare([]byte(provided), []byte(config.BackendSecret)) != 1 {
+		logger.Warnf(c.Request.Context(), "Ignoring %s header without a valid %s", ReplayIdHeader, ReplaySecretHeader)
+		return ""
+	}
+	return id
+}
+
+// Fixture 一次上游SSE会话的录制内容
+type Fixture struct {
+	ID          string          `json:"id"`
+	URL         string          `json:"url"`
+	RecordedAt  time.Time       `json:"recorded_at"`
+	RequestBody json.RawMessage `json:"request_body"`
+	Events      []FixtureEvent  `json:"events"`
+}
+
+// FixtureEvent 录制的单条SSE消息,Offset为距请求发出的毫秒数
+type FixtureEvent struct {
+	Offset int64  `json:"offset_ms"`
+	Status int    `json:"status"`
+	Raw    string `json:"raw,omitempty"`
+	Event  string `json:"event,omitempty"`
+	ID     string `json:"id,omitempty"`
+	Data   string `json:"data"`
+	Done   bool   `json:"done,omitempty"`
+}
+
+var fixtureIdPattern = regexp.MustCompile(`^[A-Za-z0-9._-]+$`)
+
+// fixturePath 校验录制ID并返回其文件路径,防止ID中携带路径穿越
+func fixturePath(dir string, id string) (string, error) {
+	if !fixtureIdPattern.MatchString(id) || id == "." || id == ".." {
+		return "", fmt.Errorf("invalid fixture id: %s", id)
+	}
+	return filepath.Join(dir, id+".json"), nil
+}
+
+// LoadFixture 读取录制文件
+func LoadFixture(dir string, id string) (*Fixture, error) {
+	path, err := fixturePath(dir, id)
+	if err != nil {
+		return nil, err
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var fixture Fixture
+	if err := json.Unmarshal(data, &fixture); err != nil {
+		return nil, fmt.Errorf("invalid fixture %s: %v", path, err)
+	}
+	return &fixture, nil
+}
+
+// Save 将录制内容写入 dir/<ID>.json
+func (f *Fixture) Save(dir string) error {
+	path, err := fixturePath(dir, f.ID)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	data, err := json.MarshalIndent(f, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// Replay 按录制顺序输出SSE消息,realtime为true时按录制时的时间间隔输出;ctx 取消时停止输出并关闭通道
+func (f *Fixture) Replay(ctx context.Context, realtime bool) <-chan cycletls.SSEResponse {
+	sseChan := make(chan cycletls.SSEResponse)
+	go func() {
+		defer close(sseChan)
+		start := time.Now()
+		for _, event := range f.Events {
+			if realtime {
+				if wait := time.Duration(event.Offset)*time.Millisecond - time.Since(start); wait > 0 {
+					timer := time.NewTimer(wait)
+					select {
+					case <-timer.C:
+					case <-ctx.Done():
+						timer.Stop()
+						return
+					}
+				}
+			}
+			select {
+			case sseChan <- cycletls.SSEResponse{
+				RequestID: f.ID,
+				Status:    event.Status,
+				Data:      event.Data,
+				Done:      event.Done,
+				FinalUrl:  f.URL,
+				Raw:       event.Raw,
+				Event:     event.Event,
+				ID:        event.ID,
+			}:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	return sseChan
+}
+
+// fixtureRecorder 转发上游SSE消息的同时记录,通道关闭后写入录制文件
+type fixtureRecorder struct {
+	dir     string
+	fixture *Fixture
+	start   time.Time
+}
+
+func newFixtureRecorder(dir string, id string, url string, body []byte) *fixtureRecorder {
+	requestBody := json.RawMessage(body)
+	if !json.Valid(body) {
+		requestBody, _ = json.Marshal(string(body))
+	}
+	return &fixtureRecorder{
+		dir: dir,
+		fixture: &Fixture{
+			ID:          id,
+			URL:         url,
+			RecordedAt:  time.Now(),
+			RequestBody: requestBody,
+		},
+		start: time.Now(),
+	}
+}
+
+// Tee 返回转发后的通道,onSaved在录制文件写入后以写入结果调用
+func (r *fixtureRecorder) Tee(ctx context.Context, source <-chan cycletls.SSEResponse, onSaved func(path string, err error)) <-chan cycletls.SSEResponse {
+	sseChan := make(chan cycletls.SSEResponse)
+	go func() {
+		defer close(sseChan)
+		for response := range source {
+			r.fixture.Events = append(r.fixture.Events, FixtureEvent{
+				Offset: time.Since(r.start).Milliseconds(),
+				Status: response.Status,
+				Raw:    response.Raw,
+				Event:  response.Event,
+				ID:     response.ID,
+				Data:   response.Data,
+				Done:   response.Done,
+			})
+			select {
+			case sseChan <- response:
+			case <-ctx.Done():
+			}
+		}
+		err := r.fixture.Save(r.dir)
+		path, _ := fixturePath(r.dir, r.fixture.ID)
+		onSaved(path, err)
+	}()
+	return sseChan
+}
+
+const fixtureSeqKey = "FixtureSeq"
+
+// nextFixtureId 同一请求多次访问上游(重试、模型降级)时,第二次起的录制ID追加序号
+func nextFixtureId(c *gin.Context) string {
+	requestId := c.GetString(helper.RequestIdKey)
+	if requestId == "" {
+		requestId = time.Now().Format("20060102T150405.000")
+	}
+	seq := c.GetInt(fixtureSeqKey) + 1
+	c.Set(fixtureSeqKey, seq)
+	if seq == 1 {
+		return requestId
+	}
+	return fmt.Sprintf("%s-%d", requestId, seq)
+}
@@ -0,0 +1,151 @@
+package qodo_api
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"qodo2api/common/config"
+	"qodo2api/cycletls"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+func TestFixturePath(t *testing.T) {
+	tests := []struct {
+		id    string
+		valid bool
+	}{
+		{id: "20250101T120000.000", valid: true},
+		{id: "req-1_a.b-2", valid: true},
+		{id: ""},
+		{id: "."},
+		{id: ".."},
+		{id: "../secret"},
+		{id: "a/b"},
+		{id: `..\\b`},
+		{id: "/etc/passwd"},
+		{id: "a\x00b"},
+	}
+	for _, tt := range tests {
+		path, err := fixturePath("/fixtures", tt.id)
+		if tt.valid {
+			if err != nil || path != filepath.Join("/fixtures", tt.id+".json") {
+				t.Errorf("fixturePath(%q) = %q, %v", tt.id, path, err)
+			}
+			continue
+		}
+		if err == nil {
+			t.Errorf("fixturePath(%q) = %q, want error", tt.id, path)
+		}
+	}
+	if _, err := LoadFixture(t.TempDir(), "../fixture"); err == nil {
+		t.Error("LoadFixture should reject path traversal")
+	}
+}
+
+func TestFixtureSaveLoad(t *testing.T) {
+	dir := t.TempDir()
+	fixture := &Fixture{
+		ID:          "save-load",
+		URL:         "https://example.com/v2/chats/chat",
+		RecordedAt:  time.Now().UTC().Truncate(time.Second),
+		RequestBody: []byte(`{"user_data":{}}`),
+		Events:      []FixtureEvent{{Offset: 5, Status: 200, Data: `{"type":"text"}`}, {Offset: 9, Status: 200, Data: "[DONE]", Done: true}},
+	}
+	if err := fixture.Save(dir); err != nil {
+		t.Fatal(err)
+	}
+	loaded, err := LoadFixture(dir, "save-load")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if loaded.ID != fixture.ID || !loaded.RecordedAt.Equal(fixture.RecordedAt) || len(loaded.Events) != 2 || loaded.Events[1] != fixture.Events[1] {
+		t.Errorf("loaded = %+v, want %+v", loaded, fixture)
+	}
+}
+
+func TestFixtureReplay(t *testing.T) {
+	fixture := &Fixture{ID: "replay", Events: []FixtureEvent{
+		{Offset: 0, Status: 200, Data: "a"},
+		{Offset: 20, Status: 200, Data: "b"},
+		{Offset: 40, Status: 200, Data: "[DONE]", Done: true},
+	}}
+	var got []string
+	for response := range fixture.Replay(context.Background(), true) {
+		got = append(got, response.Data)
+	}
+	if len(got) != 3 || got[0] != "a" || got[2] != "[DONE]" {
+		t.Errorf("replayed = %v", got)
+	}
+}
+
+// 调用方不再读取时,取消 ctx 应结束回放协程并关闭通道
+func TestFixtureReplayCancel(t *testing.T) {
+	fixture := &Fixture{ID: "cancel", Events: []FixtureEvent{
+		{Offset: 0, Data: "a"},
+		{Offset: 0, Data: "b"},
+		{Offset: int64(time.Hour / time.Millisecond), Data: "late"},
+	}}
+	for _, realtime := range []bool{false, true} {
+		ctx, cancel := context.WithCancel(context.Background())
+		sseChan := fixture.Replay(ctx, realtime)
+		<-sseChan
+		cancel()
+		select {
+		case _, ok := <-waitClosed(sseChan):
+			if ok {
+				t.Errorf("realtime=%v: channel not closed", realtime)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("realtime=%v: replay goroutine leaked after cancel", realtime)
+		}
+	}
+}
+
+// waitClosed 丢弃通道中剩余的消息,通道关闭后关闭返回的通道
+func waitClosed(source <-chan cycletls.SSEResponse) <-chan struct{} {
+	done := make(chan struct{})
+	go func() {
+		for range source {
+		}
+		close(done)
+	}()
+	return done
+}
+
+func TestReplayId(t *testing.T) {
+	oldDir, oldSecret := config.SSEReplayDir, config.BackendSecret
+	defer func() { config.SSEReplayDir, config.BackendSecret = oldDir, oldSecret }()
+
+	tests := []struct {
+		name          string
+		dir           string
+		backendSecret string
+		headers       map[string]string
+		want          string
+	}{
+		{name: "authorized", dir: "/fixtures", backendSecret: "admin", headers: map[string]string{ReplayIdHeader: "r1", ReplaySecretHeader: "admin"}, want: "r1"},
+		{name: "missing secret", dir: "/fixtures", backendSecret: "admin", headers: map[string]string{ReplayIdHeader: "r1"}},
+		{name: "wrong secret", dir: "/fixtures", backendSecret: "admin", headers: map[string]string{ReplayIdHeader: "r1", ReplaySecretHeader: "guess"}},
+		{name: "backend secret not configured", dir: "/fixtures", headers: map[string]string{ReplayIdHeader: "r1", ReplaySecretHeader: ""}},
+		{name: "replay disabled", backendSecret: "admin", headers: map[string]string{ReplayIdHeader: "r1", ReplaySecretHeader: "admin"}},
+		{name: "no replay id", dir: "/fixtures", backendSecret: "admin", headers: map[string]string{ReplaySecretHeader: "admin"}},
+	}
+	gin.SetMode(gin.TestMode)
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			config.SSEReplayDir, config.BackendSecret = tt.dir, tt.backendSecret
+			c, _ := gin.CreateTestContext(httptest.NewRecorder())
+			c.Request = httptest.NewRequest(http.MethodPost, "/v1/chat/completions", nil)
+			for k, v := range tt.headers {
+				c.Request.Header.Set(k, v)
+			}
+			if got := replayId(c); got != tt.want {
+				t.Errorf("replayId = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
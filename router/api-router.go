@@ -16,7 +16,17 @@ import (
 )
 
 func SetApiRouter(router *gin.Engine) {
+	// 健康检查不经过限流及IP黑名单
+	router.GET("/healthz", controller.Healthz)
+	router.GET("/readyz", controller.Readyz)
+	router.GET("/status", middleware.BackendAuth(), controller.Status)
+	router.GET("/metrics", middleware.BackendAuth(), controller.Metrics)
+
+	v1Path := fmt.Sprintf("%s/v1", ProcessPath(config.RoutePrefix))
+
 	router.Use(middleware.CORS())
+	// 审计先于IP黑名单及限流,被拒绝的请求同样留有记录
+	router.Use(middleware.Audit(v1Path + "/"))
 	router.Use(middleware.IPBlacklistMiddleware())
 	router.Use(middleware.RequestRateLimit())
 
@@ -27,9 +37,9 @@ func SetApiRouter(router *gin.Engine) {
 	// *有静态资源时注释此行
 	router.GET("/")
 
-	v1Router := router.Group(fmt.Sprintf("%s/v1", ProcessPath(config.RoutePrefix)))
+	v1Router := router.Group(v1Path)
 	v1Router.Use(middleware.OpenAIAuth())
-	v1Router.POST("/chat/completions", controller.ChatForOpenAI)
+	v1Router.POST("/chat/completions", middleware.TokenRateLimit(), controller.ChatForOpenAI)
 	//v1Router.POST("/images/generations", controller.ImagesForOpenAI)
 	v1Router.GET("/models", controller.OpenaiModels)
 